@@ -1,10 +1,42 @@
 package main
 
 import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
 	"fmt"
+	"html/template"
+	"io"
 	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/go-telegram-bot-api/telegram-bot-api"
 )
@@ -24,7 +56,7 @@ type ReplierRepository interface {
 // Replier replies to a given update on the Reply call.
 // It returns the reply message and the next Replier if communication is pending.
 type Replier interface {
-	Reply(Update) (string, Replier)
+	Reply(context.Context, Update) (string, Replier, error)
 }
 
 // Update is a message from a user or bot.
@@ -33,35 +65,374 @@ type Update struct {
 	Cmd       string
 	Args      []string
 	Text      string
+	// Document is the attached file, if any.
+	Document *Document
+}
+
+// Document is a file sent to the bot.
+type Document struct {
+	Name string
+	Data []byte
 }
 
 // DBProvider provides a DB for a given user.
 type DBProvider interface {
 	ProvideDB(UserID) DB
+	ListUsers() []UserID
 }
 
+// TODO: add a transaction (unit of work) API once multi-step operations (merge tags, merge notes, bulk retag) exist
+
 // DB stores all the data of a given user.
 type DB interface {
-	CreateNote(txt string, tags []string)
-	ListNotes(tags []string) string
+	CreateNote(ctx context.Context, e Entry) (Entry, error)
+	GetNote(ctx context.Context, id NoteID) (Entry, error)
+	ListNotes(ctx context.Context, f Filter) ([]Entry, error)
+	CountNotes(ctx context.Context, f Filter) (int, error)
+	DeleteNote(ctx context.Context, id NoteID) error
+	DeleteExpiredNotes(ctx context.Context, now time.Time) ([]Entry, error)
+	// UpdateNote replaces the note with the same ID.
+	UpdateNote(ctx context.Context, e Entry) error
+}
+
+// NoteID is a unique identifier for a note of a given user.
+type NoteID int
+
+// Entry represents a registered note.
+// The ID and the creation time are assigned by the DB.
+type Entry struct {
+	ID      NoteID
+	Text    string
+	Tags    []string
+	Created time.Time
+	// Expires is when the note is deleted if set.
+	Expires time.Time
+	// SharedBy is the user who sent the note if it was sent by someone else.
+	SharedBy string
+	Priority Priority
+	// PagePath is the path of the published page of the note, empty if it's not published.
+	PagePath string
+}
+
+// Priority is how important a note is. Its zero value is the normal priority.
+type Priority int
+
+const (
+	PriorityLow Priority = iota - 1
+	PriorityNormal
+	PriorityHigh
+)
+
+// String returns the name of the priority.
+func (p Priority) String() string {
+	switch p {
+	case PriorityLow:
+		return "low"
+	case PriorityHigh:
+		return "high"
+	}
+
+	return "normal"
+}
+
+// ParsePriority parses the name of a priority.
+func ParsePriority(s string) (Priority, bool) {
+	for _, p := range []Priority{PriorityLow, PriorityNormal, PriorityHigh} {
+		if s == p.String() {
+			return p, true
+		}
+	}
+
+	return PriorityNormal, false
+}
+
+// Filter selects notes. Its zero value selects all the notes.
+type Filter struct {
+	// Tags must all be present.
+	Tags []string
+	// ExcludedTags must all be absent.
+	ExcludedTags []string
+	// Phrases must all be present in the text regardless of case.
+	Phrases []string
+	// Before is the exclusive upper bound of the creation time if set.
+	Before time.Time
+	// After is the inclusive lower bound of the creation time if set.
+	After time.Time
+	// Priorities must include the priority of the note if set.
+	Priorities []Priority
+}
+
+// Services are the dependencies shared by the repliers of all the users.
+type Services struct {
+	Limits Limits
+	Quotas Quotas
+	Admins []UserID
+	// Intents interpret free-form messages if set.
+	Intents IntentParser
+	Shares  ShareRepository
+	Users   UserDirectory
+	// Messenger reaches the users out of their conversations.
+	Messenger Messenger
+	Inbox     Inbox
+	Keyboards Keyboards
+	// DeadLetters keep the updates the bot failed to handle.
+	DeadLetters DeadLetters
+	// Stats count the command usage if set.
+	Stats       UsageStats
+	Maintenance Maintenance
+	Broadcaster Broadcaster
+	// Channels archive the channel posts.
+	Channels Archiver
+	// Mailer sends emails if set.
+	Mailer Mailer
+	// Webhooks deliver the note events if set.
+	Webhooks Webhooks
+	// Publisher publishes notes as web pages if set.
+	Publisher Publisher
+	// PublicURL is the base URL of the HTTP endpoints of the bot, empty if they are disabled.
+	PublicURL string
+}
+
+// Limits restrict what users can store.
+type Limits struct {
+	// MaxNoteLength is the maximum number of characters in a note, 0 means no limit.
+	MaxNoteLength int
+	// LongNotes tells what to do with the notes over MaxNoteLength.
+	LongNotes LongNotePolicy
+	// MaxNotes is the default maximum number of notes per user, 0 means no limit.
+	MaxNotes int
+}
+
+// IntentParser interprets a free-form message as a command.
+// It reports false if the message doesn't look like any command.
+type IntentParser interface {
+	ParseIntent(ctx context.Context, txt string) (Update, bool, error)
+}
+
+// ShareRepository keeps the tokens granting read-only access to notes.
+type ShareRepository interface {
+	CreateShare(Share) (string, error)
+	ProvideShare(token string) (Share, bool)
+	DeleteShare(uid UserID, token string) bool
+}
+
+// Share grants read-only access to the notes of a user under a tag or, if the tag is empty, to all of them.
+type Share struct {
+	UserID UserID
+	Tag    string
+}
+
+// TODO: add shared workspaces with owner, editor and viewer roles enforced in cmdExecer (viewers may only list and search)
+
+// TODO: invite to workspaces through /start deep link payloads recording the membership and the role, once workspaces exist
+
+// UserDirectory remembers the Telegram usernames of the users.
+type UserDirectory interface {
+	SaveUser(uid UserID, username string)
+	FindUser(username string) (UserID, bool)
+	UserName(UserID) string
+	// ListUsers returns all the users who talked to the bot, with or without a username.
+	ListUsers() []UserID
+}
+
+// Broadcaster sends a message to many users in the background, one at a time.
+type Broadcaster interface {
+	// StartBroadcast starts sending the text to the users unless another broadcast is running.
+	StartBroadcast(requester UserID, text string, to []UserID) bool
+	// BroadcastProgress tells how many users the message was sent to out of how many.
+	BroadcastProgress() (sent int, total int, running bool)
+	AbortBroadcast() bool
+}
+
+// Archiver keeps the posts of the channels the bot is an admin of as notes of the channel.
+type Archiver interface {
+	ArchivePost(ctx context.Context, channel UserID, username string, text string) error
+	// ChannelDB returns the notebook of the channel given as @username or ID to an admin of the channel.
+	ChannelDB(ctx context.Context, channel string, uid UserID) (DB, error)
+}
+
+// ErrUnknownChannel is returned for a channel that has no archived posts.
+var ErrUnknownChannel = errors.New("unknown channel")
+
+// ErrNotChannelAdmin is returned when the user is not an admin of the channel.
+var ErrNotChannelAdmin = errors.New("not an admin of the channel")
+
+// Messenger sends messages to users out of their conversations.
+type Messenger interface {
+	SendMessage(ctx context.Context, uid UserID, txt string) error
+}
+
+// DeadLetters keep the updates the bot failed to handle for the admins to inspect and replay.
+type DeadLetters interface {
+	AddDeadLetter(DeadLetter) int
+	ListDeadLetters() []DeadLetter
+	TakeDeadLetter(id int) (DeadLetter, bool)
+}
+
+// DeadLetter is an update the bot failed to handle.
+type DeadLetter struct {
+	ID     int
+	UserID UserID
+	Update Update
+	// Replier is the one that failed, so that the update is replayed within its conversation.
+	Replier Replier
+	Err     string
+	Time    time.Time
+}
+
+// Inbox keeps the notes sent to users until they accept them.
+type Inbox interface {
+	// Deliver puts the note into the inbox of the user and returns its number there.
+	Deliver(UserID, Entry) int
+	// Take removes the note with the given number from the inbox of the user.
+	Take(UserID, int) (Entry, bool)
+}
+
+// Mailer sends emails in the background.
+type Mailer interface {
+	QueueMail(Mail) error
+}
+
+// Mail is an email requested by a user.
+type Mail struct {
+	Requester UserID
+	To        string
+	Subject   string
+	Body      string
+}
+
+// ErrMailQueueFull is returned when too many emails are waiting to be sent.
+var ErrMailQueueFull = errors.New("mail queue is full")
+
+// Keyboards remember which users want the reply keyboard with the common commands.
+type Keyboards interface {
+	SetKeyboard(uid UserID, on bool)
+	Keyboard(UserID) bool
+	// TakeKeyboardChange tells whether the keyboard was toggled since the last call.
+	TakeKeyboardChange(UserID) bool
+}
+
+// Publisher publishes notes as web pages.
+type Publisher interface {
+	// Publish publishes the note (or updates its page if it's published already) and returns the path and the URL of the page.
+	Publish(ctx context.Context, author string, e Entry) (path string, link string, err error)
+}
+
+// Webhooks deliver the note events to the URLs configured by the users.
+type Webhooks interface {
+	// SetWebhook configures the URL and returns the secret the payloads are signed with.
+	SetWebhook(uid UserID, url string) (string, error)
+	DeleteWebhook(UserID) bool
+	Emit(UserID, Event)
+}
+
+// Event is a change of a note.
+type Event struct {
+	Type EventType
+	Note Entry
+	Time time.Time
 }
 
+// EventType is a kind of a change of a note.
+type EventType string
+
+const (
+	NoteCreated EventType = "note.created"
+	NoteUpdated EventType = "note.updated"
+	NoteDeleted EventType = "note.deleted"
+)
+
+// Outbox sends the messages in the background until they are delivered.
+type Outbox interface {
+	Enqueue(OutgoingMessage) error
+}
+
+// OutgoingMessage is a message waiting to be sent.
+type OutgoingMessage struct {
+	ChatID   int64          `json:"chat_id"`
+	Text     string         `json:"text"`
+	Keyboard KeyboardChange `json:"keyboard,omitempty"`
+	// Attempts is how many times sending the message failed.
+	Attempts int `json:"attempts,omitempty"`
+	// NextAttempt is when to try sending the message again after a failure.
+	NextAttempt time.Time `json:"next_attempt,omitempty"`
+}
+
+// KeyboardChange tells what to do with the reply keyboard along with a message.
+type KeyboardChange string
+
+const (
+	KeyboardUnchanged KeyboardChange = ""
+	KeyboardShown     KeyboardChange = "shown"
+	KeyboardHidden    KeyboardChange = "hidden"
+)
+
+// ErrUndeliverable is returned when a message will never be delivered (e.g. the bot is blocked).
+var ErrUndeliverable = errors.New("message is undeliverable")
+
+// OutboxJournal keeps the messages pending in an outbox across restarts.
+type OutboxJournal interface {
+	LoadOutbox() ([]OutgoingMessage, error)
+	SaveOutbox([]OutgoingMessage) error
+}
+
+// OffsetStore keeps the ID of the last handled Telegram update of a bot.
+type OffsetStore interface {
+	LoadOffset() (int, error)
+	SaveOffset(int) error
+}
+
+// Maintenance tells whether the bot is under maintenance, answering only the admins.
+type Maintenance interface {
+	// SetMaintenance turns the maintenance on with the message for the users (the default one if it's empty) or off.
+	SetMaintenance(on bool, message string)
+	// Maintenance returns the message for the users if the maintenance is on.
+	Maintenance() (string, bool)
+}
+
+// UsageStats count how many times the commands are run, without telling who ran them or with what.
+type UsageStats interface {
+	CountCommand(cmd string)
+	CommandCounts() map[string]int
+}
+
+// Quotas keep the maximum number of notes per user.
+type Quotas interface {
+	MaxNotes(UserID) int
+	SetMaxNotes(UserID, int)
+}
+
+// LongNotePolicy tells what to do with a note over the length limit.
+type LongNotePolicy string
+
+const (
+	RejectLongNotes LongNotePolicy = "reject"
+	SplitLongNotes  LongNotePolicy = "split"
+)
+
+// ErrNoteNotFound is returned when there is no note with the given ID.
+var ErrNoteNotFound = errors.New("note not found")
+
 // prototype/replier_repository.go
 
+// TODO: add a distributed (Redis) replier repository for multi-instance deployments once repliers are serializable (bodyExpector is a closure)
+
 type replierRepository struct {
 	sync.RWMutex
-	repo map[UserID]Replier
-	db   DBProvider
+	repo     map[UserID]Replier
+	db       DBProvider
+	services Services
 }
 
 // replierRepository implements the ReplierRepository interface.
 var _ ReplierRepository = (*replierRepository)(nil)
 
 // NewReplierRepository creates a replier repository.
-func NewReplierRepository(db DBProvider) ReplierRepository {
+func NewReplierRepository(db DBProvider, s Services) ReplierRepository {
 	return &replierRepository{
-		repo: map[UserID]Replier{},
-		db:   db,
+		repo:     map[UserID]Replier{},
+		db:       db,
+		services: s,
 	}
 }
 
@@ -70,11 +441,18 @@ func (rp *replierRepository) ProvideReplier(uid UserID) Replier {
 	rp.RLock()
 	defer rp.RUnlock()
 
+	if message, ok := rp.services.Maintenance.Maintenance(); ok && !isAdmin(rp.services.Admins, uid) {
+		return &maintenanceReplier{
+			message: message,
+			pending: rp.repo[uid],
+		}
+	}
+
 	if result := rp.repo[uid]; result != nil {
 		return result
 	}
 
-	return NewCmdExecer(rp.db.ProvideDB(uid))
+	return NewCmdExecer(uid, rp.db.ProvideDB(uid), rp.services)
 }
 
 // SaveReplier saves the replier for coninuing the conversation.
@@ -99,238 +477,5434 @@ func (rp *replierRepository) DeleteReplier(uid UserID) {
 
 // cmdExecer executes a Telegram command.
 type cmdExecer struct {
-	db DB
+	uid      UserID
+	db       DB
+	services Services
 }
 
 // cmdExecer implements the Replier interface.
 var _ Replier = (*cmdExecer)(nil)
 
 // NewCmdExecer creates a Telegram command executor.
-func NewCmdExecer(db DB) Replier {
+func NewCmdExecer(uid UserID, db DB, s Services) Replier {
 	return &cmdExecer{
-		db: db,
+		uid:      uid,
+		db:       db,
+		services: s,
 	}
 }
 
 // Reply executes a Telegram command.
-func (ce cmdExecer) Reply(u Update) (string, Replier) {
+func (ce cmdExecer) Reply(ctx context.Context, u Update) (string, Replier, error) {
+	if cmd, ok := GetButtonCmd(u.Text); ok && !u.IsCommand {
+		u = Update{
+			IsCommand: true,
+			Cmd:       cmd,
+			Args:      []string{},
+			Text:      "/" + cmd,
+		}
+	}
+
 	if !u.IsCommand {
-		return GetUsage(), nil
+		return ce.interpret(ctx, u)
+	}
+
+	// Counting only the known commands, for anything else might be personal.
+	if ce.services.Stats != nil && (GetCmdUsage(u.Cmd) != "" || u.Cmd == "admin") {
+		ce.services.Stats.CountCommand(u.Cmd)
 	}
 
 	// TODO: register commands in a nice way in the cmd/ package and use them over here
 
 	if u.Cmd == "listnotes" {
-		result := ce.db.ListNotes(toTags(u.Args))
-		if result == "" {
-			result = "No notes satisfy the search criteria! :("
+		o, ok := toListOptions(u.Args)
+		if !ok {
+			return "Please, run it as " + GetCmdUsage(u.Cmd), nil, nil
 		}
 
-		return result, nil
-	}
-
-	if u.Cmd == "createnote" {
-		var next bodyExpector = func(txt string) {
-			ce.db.CreateNote(txt, toTags(u.Args))
+		f := Filter{
+			Tags:       o.Tags,
+			Priorities: o.Priorities,
 		}
 
-		return "Please, enter the body of the new note!", &next
-	}
+		if o.Count {
+			n, err := ce.db.CountNotes(ctx, f)
+			if err != nil {
+				return "", nil, err
+			}
 
-	return GetUsage(), nil
-}
+			return fmt.Sprintf("Notes found: %d", n), nil, nil
+		}
 
-// bodyExpector expects a new note body.
-type bodyExpector func(string)
+		if !o.ByPriority {
+			return ce.list(ctx, f)
+		}
 
-// bodyExecutor implements the Replier interface.
-var _ Replier = (*bodyExpector)(nil)
+		entries, err := ce.db.ListNotes(ctx, f)
+		if err != nil {
+			return "", nil, err
+		}
 
-// Reply add the new message to the registry and outputs a happy reply.
-func (be bodyExpector) Reply(u Update) (string, Replier) {
-	be(u.Text)
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].Priority > entries[j].Priority
+		})
 
-	return "Successfully added a new note! Hooray!", nil
-}
+		return ce.enumerate(entries, &f)
+	}
 
-// TODO: use pflags or something
+	if u.Cmd == "find" {
+		if len(u.Args) == 0 {
+			return "Please, enter the search query, e.g. " + strings.TrimPrefix(GetCmdUsage(u.Cmd), "/find "), &queryExpector{next: ce}, nil
+		}
 
-func toTags(args []string) []string {
-	// TODO: add normal validation and erroring
+		count := false
+		terms := []string{}
+		for _, a := range u.Args {
+			if a == "--count" {
+				count = true
+				continue
+			}
 
-	if len(args) != 2 {
-		return nil
-	}
+			terms = append(terms, a)
+		}
 
-	if args[0] != "--tag" {
-		return nil
-	}
+		f, err := ParseQuery(strings.Join(terms, " "))
+		if err != nil {
+			return fmt.Sprintf("Can't parse the query (%v)! Please, run it as %s", err, GetCmdUsage(u.Cmd)), nil, nil
+		}
 
-	return strings.Split(args[1], ",")
-}
+		if count {
+			n, err := ce.db.CountNotes(ctx, f)
+			if err != nil {
+				return "", nil, err
+			}
 
-// cmd/cmd.go
-// cmd/createnote.go
-// cmd/listnotest.go
+			return fmt.Sprintf("Notes found: %d", n), nil, nil
+		}
 
-// TODO: clear all DB data at some point
+		return ce.list(ctx, f)
+	}
 
-// TODO: use cobra or something for commands
+	if u.Cmd == "recent" {
+		n := defaultRecent
+		if len(u.Args) > 1 {
+			return "Please, run it as " + GetCmdUsage(u.Cmd), nil, nil
+		}
 
-// CmdID is an ID of a Telegram command.
-type CmdID string
+		if len(u.Args) == 1 {
+			var err error
+			if n, err = strconv.Atoi(u.Args[0]); err != nil || n <= 0 {
+				return "Please, run it as " + GetCmdUsage(u.Cmd), nil, nil
+			}
+		}
 
-// TODO: drop it in favor of registering per file
+		entries, err := ce.db.ListNotes(ctx, Filter{})
+		if err != nil {
+			return "", nil, err
+		}
 
-var Cmds []Cmd = []Cmd{
-	{
-		ID:    "createnote",
-		Usage: "/createnote [--tag work,concentration]",
-	},
-	{
-		ID:    "listnotes",
-		Usage: "/listnotes [--tag work]",
-	},
-}
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].Created.After(entries[j].Created)
+		})
 
-// Cmd describes a Telegram command.
-type Cmd struct {
-	ID    string
-	Usage string
-}
+		if len(entries) > n {
+			entries = entries[:n]
+		}
 
-// GetUsage returns usage of all the Telegram commands.
-func GetUsage() string {
-	result := []string{}
-	for _, cmd := range Cmds {
-		result = append(result, cmd.Usage)
+		return ce.enumerate(entries, nil)
 	}
 
-	return fmt.Sprintf(`Run one of
+	if u.Cmd == "today" {
+		today := startOfDay(time.Now())
 
-%s
+		return ce.list(ctx, Filter{
+			After:  today,
+			Before: today.AddDate(0, 0, 1),
+		})
+	}
 
-to let the magic happen!
-`, strings.Join(result, "\n"))
-}
+	if u.Cmd == "onthisday" {
+		today := startOfDay(time.Now())
+		entries := []Entry{}
+		for years := 1; ; years++ {
+			day := today.AddDate(-years, 0, 0)
+			n, err := ce.db.CountNotes(ctx, Filter{Before: day.AddDate(0, 0, 1)})
+			if err != nil {
+				return "", nil, err
+			}
 
-// prototype/db_provider.go
+			if n == 0 {
+				break
+			}
 
-// TODO: consider moving it to core or something (with the injected DB creator)
+			found, err := ce.db.ListNotes(ctx, Filter{
+				After:  day,
+				Before: day.AddDate(0, 0, 1),
+			})
+			if err != nil {
+				return "", nil, err
+			}
 
-func NewDBProvider() DBProvider {
-	return &dbProvider{
-		repo: map[UserID]DB{},
+			entries = append(entries, found...)
+		}
+
+		return ce.enumerate(entries, nil)
 	}
-}
 
-type dbProvider struct {
-	sync.RWMutex
-	repo map[UserID]DB
-}
+	if u.Cmd == "shownote" {
+		id, ok := toNoteID(u.Args)
+		if !ok {
+			return "Please, specify the note ID, e.g. /shownote 1", nil, nil
+		}
 
-// dbProvider implements the DBProvider interface.
-var _ DBProvider = (*dbProvider)(nil)
+		e, err := ce.db.GetNote(ctx, id)
+		if errors.Is(err, ErrNoteNotFound) {
+			return fmt.Sprintf("There is no note #%d! :(", id), nil, nil
+		}
 
-// ProvideDB returns a prototype DB for a given user.
-func (dbp *dbProvider) ProvideDB(uid UserID) DB {
-	if db := dbp.getDB(uid); db != nil {
-		return db
+		if err != nil {
+			return "", nil, err
+		}
+
+		return fmt.Sprintf("%s\n\n%s", header(e), e.Text), nil, nil
 	}
 
-	dbp.Lock()
-	defer dbp.Unlock()
+	if u.Cmd == "deletenote" {
+		id, ok := toNoteID(u.Args)
+		if !ok {
+			return "Please, specify the note ID, e.g. /deletenote 1", nil, nil
+		}
 
-	db := NewDB()
+		e, err := ce.db.GetNote(ctx, id)
+		if errors.Is(err, ErrNoteNotFound) {
+			return fmt.Sprintf("There is no note #%d! :(", id), nil, nil
+		}
 
-	dbp.repo[uid] = db
+		if err != nil {
+			return "", nil, err
+		}
 
-	return db
-}
+		err = ce.db.DeleteNote(ctx, id)
+		if errors.Is(err, ErrNoteNotFound) {
+			return fmt.Sprintf("There is no note #%d! :(", id), nil, nil
+		}
 
-// getDB safely returns a DB from the provider.
-func (dbp *dbProvider) getDB(uid UserID) DB {
-	dbp.RLock()
-	defer dbp.RUnlock()
+		if err != nil {
+			return "", nil, err
+		}
 
-	return dbp.repo[uid]
-}
+		return fmt.Sprintf("Successfully deleted note %s", preview(e)), nil, nil
+	}
 
-// prototype/db.go
+	if u.Cmd == "sendnote" {
+		if len(u.Args) != 2 {
+			return "Please, run it as " + GetCmdUsage(u.Cmd), nil, nil
+		}
 
-// TODO: use some normal DB
+		id, ok := parseNoteID(u.Args[0])
+		if !ok {
+			return "Please, run it as " + GetCmdUsage(u.Cmd), nil, nil
+		}
 
-// NewDB creates a new prototype DB.
-func NewDB() DB {
-	return &db{}
-}
+		to, ok := ce.services.Users.FindUser(u.Args[1])
+		if !ok {
+			return fmt.Sprintf("I don't know %s! They have to start a conversation with me first.", u.Args[1]), nil, nil
+		}
 
-// db is a prototype db.
-type db struct {
-	repo []Entry
-}
+		e, err := ce.db.GetNote(ctx, id)
+		if errors.Is(err, ErrNoteNotFound) {
+			return fmt.Sprintf("There is no note #%d! :(", id), nil, nil
+		}
 
-// Entry represents a registered note.
-type Entry struct {
-	Text string
-	Tags []string
-}
+		if err != nil {
+			return "", nil, err
+		}
 
-// db implements the DB interface.
-var _ DB = (*db)(nil)
+		e.SharedBy = ce.services.Users.UserName(ce.uid)
+		n := ce.services.Inbox.Deliver(to, e)
+		txt := fmt.Sprintf("%s sent you a note:\n\n%s\n\nRun /acceptnote %d to save it.", e.SharedBy, e.Text, n)
+		if err := ce.services.Messenger.SendMessage(ctx, to, txt); err != nil {
+			return "", nil, err
+		}
 
-// CreateNote adds a note to a prototype DB.
-func (db *db) CreateNote(txt string, tags []string) {
-	db.repo = append(db.repo, Entry{
-		Text: txt,
-		Tags: tags,
-	})
-}
+		return fmt.Sprintf("Successfully sent note #%d to %s!", id, u.Args[1]), nil, nil
+	}
 
-// ListNotes returns seleted notes for a prototype DB.
-func (db *db) ListNotes(tags []string) string {
-	result := []string{}
-	for _, e := range db.repo {
-		skip := false
-		for _, tag := range tags {
-			found := false
-			for _, t := range e.Tags {
-				if t == tag {
-					found = true
-					break
-				}
-			}
+	if u.Cmd == "emailnote" {
+		if len(u.Args) != 2 {
+			return "Please, run it as " + GetCmdUsage(u.Cmd), nil, nil
+		}
 
-			if !found {
-				skip = true
-				break
-			}
+		if ce.services.Mailer == nil {
+			return "Emailing is disabled on this bot! :(", nil, nil
 		}
 
-		if skip {
-			continue
+		id, ok := parseNoteID(u.Args[0])
+		if !ok {
+			return "Please, run it as " + GetCmdUsage(u.Cmd), nil, nil
 		}
 
-		result = append(result, e.Text)
-	}
+		to, err := mail.ParseAddress(u.Args[1])
+		if err != nil {
+			return fmt.Sprintf("%s is not an email address!", u.Args[1]), nil, nil
+		}
 
-	return strings.Join(result, "\n\n")
-}
+		e, err := ce.db.GetNote(ctx, id)
+		if errors.Is(err, ErrNoteNotFound) {
+			return fmt.Sprintf("There is no note #%d! :(", id), nil, nil
+		}
 
-// main.go
+		if err != nil {
+			return "", nil, err
+		}
 
-func main() {
-	// Creating a bot.
-	bot, err := tgbotapi.NewBotAPI("TOKEN")
-	if err != nil {
-		log.Panic(err)
-	}
+		err = ce.services.Mailer.QueueMail(Mail{
+			Requester: ce.uid,
+			To:        to.Address,
+			Subject:   preview(e),
+			Body:      e.Text,
+		})
+		if errors.Is(err, ErrMailQueueFull) {
+			return "Too many emails are waiting to be sent! Please, try again later.", nil, nil
+		}
 
-	log.Printf("Authorized on account %s", bot.Self.UserName)
+		if err != nil {
+			return "", nil, err
+		}
 
-	// Configuring the bot.
-	u := tgbotapi.NewUpdate(0)
-	u.Timeout = 60
+		return fmt.Sprintf("Note #%d will be emailed to %s shortly!", id, to.Address), nil, nil
+	}
+
+	if u.Cmd == "publish" {
+		id, ok := toNoteID(u.Args)
+		if !ok {
+			return "Please, run it as " + GetCmdUsage(u.Cmd), nil, nil
+		}
+
+		if ce.services.Publisher == nil {
+			return "Publishing is disabled on this bot! :(", nil, nil
+		}
+
+		e, err := ce.db.GetNote(ctx, id)
+		if errors.Is(err, ErrNoteNotFound) {
+			return fmt.Sprintf("There is no note #%d! :(", id), nil, nil
+		}
+
+		if err != nil {
+			return "", nil, err
+		}
+
+		path, link, err := ce.services.Publisher.Publish(ctx, ce.services.Users.UserName(ce.uid), e)
+		if err != nil {
+			return "", nil, err
+		}
+
+		// Remembering the page along with the note, so that it's updated rather than duplicated next time.
+		if path != e.PagePath {
+			e.PagePath = path
+			if err := ce.db.UpdateNote(ctx, e); err != nil {
+				return "", nil, err
+			}
+		}
+
+		return fmt.Sprintf("Note #%d is published at %s", id, link), nil, nil
+	}
+
+	if u.Cmd == "priority" {
+		if len(u.Args) != 2 {
+			return "Please, run it as " + GetCmdUsage(u.Cmd), nil, nil
+		}
+
+		id, ok := parseNoteID(u.Args[0])
+		if !ok {
+			return "Please, run it as " + GetCmdUsage(u.Cmd), nil, nil
+		}
+
+		p, ok := ParsePriority(u.Args[1])
+		if !ok {
+			return "Please, run it as " + GetCmdUsage(u.Cmd), nil, nil
+		}
+
+		e, err := ce.db.GetNote(ctx, id)
+		if errors.Is(err, ErrNoteNotFound) {
+			return fmt.Sprintf("There is no note #%d! :(", id), nil, nil
+		}
+
+		if err != nil {
+			return "", nil, err
+		}
+
+		e.Priority = p
+		if err := ce.db.UpdateNote(ctx, e); err != nil {
+			return "", nil, err
+		}
+
+		return fmt.Sprintf("Note #%d is of %s priority now!", id, p), nil, nil
+	}
+
+	if u.Cmd == "acceptnote" {
+		if len(u.Args) != 1 {
+			return "Please, run it as " + GetCmdUsage(u.Cmd), nil, nil
+		}
+
+		n, err := strconv.Atoi(u.Args[0])
+		if err != nil {
+			return "Please, run it as " + GetCmdUsage(u.Cmd), nil, nil
+		}
+
+		e, ok := ce.services.Inbox.Take(ce.uid, n)
+		if !ok {
+			return "There is no such note in your inbox! :(", nil, nil
+		}
+
+		txt, err := ce.createNote(ctx, Entry{
+			Text:     e.Text,
+			Tags:     e.Tags,
+			SharedBy: e.SharedBy,
+		})
+		if err != nil {
+			return "", nil, err
+		}
+
+		return txt, nil, nil
+	}
+
+	if u.Cmd == "import" {
+		return fmt.Sprintf("Please, send the export file (%s)!", importFormats()), &documentExpector{next: ce, handle: ce.importNotes}, nil
+	}
+
+	if u.Cmd == "createnote" {
+		o, ok := toCreateOptions(u.Args)
+		if !ok {
+			return "Please, run it as " + GetCmdUsage(u.Cmd), nil, nil
+		}
+
+		var next bodyExpector = func(ctx context.Context, txt string) (string, error) {
+			e := Entry{
+				Text:     txt,
+				Tags:     o.Tags,
+				Priority: o.Priority,
+			}
+
+			if o.Expires != 0 {
+				e.Expires = time.Now().Add(o.Expires)
+			}
+
+			return ce.createNote(ctx, e)
+		}
+
+		return "Please, enter the body of the new note!", &next, nil
+	}
+
+	if u.Cmd == "channelnotes" {
+		if len(u.Args) == 0 {
+			return "Please, run it as " + GetCmdUsage(u.Cmd), nil, nil
+		}
+
+		o, ok := toListOptions(u.Args[1:])
+		if !ok || o.Count || o.ByPriority {
+			return "Please, run it as " + GetCmdUsage(u.Cmd), nil, nil
+		}
+
+		db, err := ce.services.Channels.ChannelDB(ctx, u.Args[0], ce.uid)
+		if errors.Is(err, ErrUnknownChannel) {
+			return fmt.Sprintf("No posts of %s are archived! Please, add the bot to the channel as an admin first.", u.Args[0]), nil, nil
+		} else if errors.Is(err, ErrNotChannelAdmin) {
+			return fmt.Sprintf("Only the admins of %s can read its notes! :(", u.Args[0]), nil, nil
+		} else if err != nil {
+			return "", nil, err
+		}
+
+		entries, err := db.ListNotes(ctx, Filter{
+			Tags:       o.Tags,
+			Priorities: o.Priorities,
+		})
+		if err != nil {
+			return "", nil, err
+		}
+
+		if len(entries) == 0 {
+			return "No notes satisfy the search criteria! :(", nil, nil
+		}
+
+		// Not a listing, for the numbers would refer to the notes of the user.
+		result := []string{}
+		for _, e := range entries {
+			result = append(result, preview(e))
+		}
+
+		return strings.Join(result, "\n\n"), nil, nil
+	}
+
+	if u.Cmd == "sharetag" {
+		if len(u.Args) != 1 {
+			return "Please, run it as " + GetCmdUsage(u.Cmd), nil, nil
+		}
+
+		if ce.services.PublicURL == "" {
+			return "Sharing is disabled on this bot! :(", nil, nil
+		}
+
+		token, err := ce.services.Shares.CreateShare(Share{
+			UserID: ce.uid,
+			Tag:    u.Args[0],
+		})
+		if err != nil {
+			return "", nil, err
+		}
+
+		return fmt.Sprintf("Anyone with the link can read your notes tagged %s:\n\n%s/shared/%s\n\nRun /unsharetag %s to revoke it.", u.Args[0], ce.services.PublicURL, token, token), nil, nil
+	}
+
+	if u.Cmd == "unsharetag" {
+		if len(u.Args) != 1 {
+			return "Please, run it as " + GetCmdUsage(u.Cmd), nil, nil
+		}
+
+		if !ce.services.Shares.DeleteShare(ce.uid, u.Args[0]) {
+			return "There is no such link! :(", nil, nil
+		}
+
+		return "Successfully revoked the link!", nil, nil
+	}
+
+	if u.Cmd == "feed" {
+		if len(u.Args) > 1 {
+			return "Please, run it as " + GetCmdUsage(u.Cmd), nil, nil
+		}
+
+		if ce.services.PublicURL == "" {
+			return "Feeds are disabled on this bot! :(", nil, nil
+		}
+
+		s := Share{UserID: ce.uid}
+		if len(u.Args) == 1 {
+			s.Tag = u.Args[0]
+		}
+
+		token, err := ce.services.Shares.CreateShare(s)
+		if err != nil {
+			return "", nil, err
+		}
+
+		return fmt.Sprintf("Subscribe to your recent notes in any feed reader:\n\n%s/feed/%s\n\nRun /unsharetag %s to revoke it.", ce.services.PublicURL, token, token), nil, nil
+	}
+
+	if u.Cmd == "keyboard" {
+		if len(u.Args) > 1 {
+			return "Please, run it as " + GetCmdUsage(u.Cmd), nil, nil
+		}
+
+		on := !ce.services.Keyboards.Keyboard(ce.uid)
+		if len(u.Args) == 1 {
+			switch u.Args[0] {
+			case "on":
+				on = true
+			case "off":
+				on = false
+			default:
+				return "Please, run it as " + GetCmdUsage(u.Cmd), nil, nil
+			}
+		}
+
+		ce.services.Keyboards.SetKeyboard(ce.uid, on)
+
+		if on {
+			return "Here is the keyboard! Run /keyboard off to hide it.", nil, nil
+		}
+
+		return "The keyboard is hidden! Run /keyboard on to bring it back.", nil, nil
+	}
+
+	if u.Cmd == "setwebhook" {
+		if len(u.Args) != 1 {
+			return "Please, run it as " + GetCmdUsage(u.Cmd), nil, nil
+		}
+
+		if ce.services.Webhooks == nil {
+			return "Webhooks are disabled on this bot! :(", nil, nil
+		}
+
+		if target, err := url.Parse(u.Args[0]); err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			return fmt.Sprintf("%s is not an HTTP URL!", u.Args[0]), nil, nil
+		}
+
+		secret, err := ce.services.Webhooks.SetWebhook(ce.uid, u.Args[0])
+		if err != nil {
+			return "", nil, err
+		}
+
+		return fmt.Sprintf("Note events will be posted to %s! Each payload is signed in the X-Signature header as sha256=HMAC-SHA256(body) with the secret %s", u.Args[0], secret), nil, nil
+	}
+
+	if u.Cmd == "unsetwebhook" {
+		if ce.services.Webhooks == nil || !ce.services.Webhooks.DeleteWebhook(ce.uid) {
+			return "There is no webhook to remove! :(", nil, nil
+		}
+
+		return "Successfully removed the webhook!", nil, nil
+	}
+
+	if u.Cmd == "admin" && ce.isAdmin() {
+		return ce.admin(ctx, u.Args)
+	}
+
+	return GetUsage(), nil, nil
+}
+
+// interpret asks to confirm the command the free-form message looks like.
+func (ce cmdExecer) interpret(ctx context.Context, u Update) (string, Replier, error) {
+	if ce.services.Intents == nil {
+		return GetUsage(), nil, nil
+	}
+
+	cmd, ok, err := ce.services.Intents.ParseIntent(ctx, u.Text)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if !ok {
+		return GetUsage(), nil, nil
+	}
+
+	next := &intentConfirmer{
+		next: ce,
+		cmd:  cmd,
+	}
+
+	return fmt.Sprintf("Did you mean %s? Reply yes to run it.", cmd.Text), next, nil
+}
+
+// list replies with the numbered previews of the selected notes.
+func (ce cmdExecer) list(ctx context.Context, f Filter) (string, Replier, error) {
+	entries, err := ce.db.ListNotes(ctx, f)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return ce.enumerate(entries, &f)
+}
+
+// enumerate renders the numbered previews of the notes and remembers the numbers
+// along with the filter selecting them (if any) to let the user narrow it down.
+func (ce cmdExecer) enumerate(entries []Entry, f *Filter) (string, Replier, error) {
+	if len(entries) == 0 {
+		return "No notes satisfy the search criteria! :(", nil, nil
+	}
+
+	// TODO: put pinned notes first (marked) using a multi-key comparator once pinning exists
+
+	result := []string{}
+	ids := []NoteID{}
+	for i, e := range entries {
+		// Showing only the listing numbers, for the note IDs would be mistaken for them.
+		txt := snippet(e)
+		if f != nil && len(f.Phrases) != 0 {
+			txt = matchSnippet(e, f.Phrases[0])
+		}
+
+		result = append(result, fmt.Sprintf("%d.%s %s", i+1, labels(e), txt))
+		ids = append(ids, e.ID)
+	}
+
+	next := &listing{
+		next:    ce,
+		ids:     ids,
+		filter:  f,
+		expires: time.Now().Add(listingTTL),
+	}
+
+	return strings.Join(result, "\n\n"), next, nil
+}
+
+// startOfDay returns the midnight of the day of the time.
+func startOfDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// defaultRecent is the number of notes /recent shows by default.
+const defaultRecent = 5
+
+// createNote adds the note within the limits and tells how it went.
+func (ce cmdExecer) createNote(ctx context.Context, e Entry) (string, error) {
+	limits := ce.services.Limits
+	parts := []string{e.Text}
+	if n := utf8.RuneCountInString(e.Text); limits.MaxNoteLength != 0 && n > limits.MaxNoteLength {
+		if limits.LongNotes != SplitLongNotes {
+			return fmt.Sprintf("The note is too long (%d characters)! Please, keep it within %d characters and run /createnote again.", n, limits.MaxNoteLength), nil
+		}
+
+		parts = splitText(e.Text, limits.MaxNoteLength)
+	}
+
+	if max := ce.services.Quotas.MaxNotes(ce.uid); max != 0 {
+		n, err := ce.db.CountNotes(ctx, Filter{})
+		if err != nil {
+			return "", err
+		}
+
+		if n+len(parts) > max {
+			return fmt.Sprintf("You can store up to %d notes, and you have %d already! Please, clean up with /deletenote or ask an admin to raise the limit for user %d.", max, n, ce.uid), nil
+		}
+	}
+
+	for _, p := range parts {
+		e.Text = p
+		if _, err := ce.db.CreateNote(ctx, e); err != nil {
+			return "", err
+		}
+	}
+
+	if len(parts) == 1 {
+		return "Successfully added a new note! Hooray!", nil
+	}
+
+	return fmt.Sprintf("The note was too long, so it was added as %d notes! Hooray!", len(parts)), nil
+}
+
+// importNotes adds the notes from the export file within the limits and tells how it went.
+func (ce cmdExecer) importNotes(ctx context.Context, d Document) (string, error) {
+	i, ok := importerFor(d.Name)
+	if !ok {
+		return fmt.Sprintf("Can't import %s! Please, send one of %s.", d.Name, importFormats()), nil
+	}
+
+	entries, err := i(d.Data)
+	if err != nil {
+		return fmt.Sprintf("Can't read %s (%v)! :(", d.Name, err), nil
+	}
+
+	limits := ce.services.Limits
+	notes := []Entry{}
+	tooLong := 0
+	for _, e := range entries {
+		if limits.MaxNoteLength == 0 || utf8.RuneCountInString(e.Text) <= limits.MaxNoteLength {
+			notes = append(notes, e)
+			continue
+		}
+
+		if limits.LongNotes != SplitLongNotes {
+			tooLong++
+			continue
+		}
+
+		for _, p := range splitText(e.Text, limits.MaxNoteLength) {
+			e.Text = p
+			notes = append(notes, e)
+		}
+	}
+
+	overQuota := 0
+	if max := ce.services.Quotas.MaxNotes(ce.uid); max != 0 {
+		n, err := ce.db.CountNotes(ctx, Filter{})
+		if err != nil {
+			return "", err
+		}
+
+		if free := max - n; len(notes) > free {
+			if free < 0 {
+				free = 0
+			}
+
+			overQuota = len(notes) - free
+			notes = notes[:free]
+		}
+	}
+
+	tags := map[string]bool{}
+	for _, e := range notes {
+		if _, err := ce.db.CreateNote(ctx, e); err != nil {
+			return "", err
+		}
+
+		for _, t := range e.Tags {
+			tags[t] = true
+		}
+	}
+
+	result := []string{fmt.Sprintf("Successfully imported %d notes with %d tags from %s! Hooray!", len(notes), len(tags), d.Name)}
+	if tooLong != 0 {
+		result = append(result, fmt.Sprintf("Skipped %d notes over %d characters.", tooLong, limits.MaxNoteLength))
+	}
+
+	if overQuota != 0 {
+		result = append(result, fmt.Sprintf("Skipped %d notes over your limit of %d notes.", overQuota, ce.services.Quotas.MaxNotes(ce.uid)))
+	}
+
+	return strings.Join(result, "\n"), nil
+}
+
+// splitText splits the text into non-empty parts of at most n characters, preferably on whitespace.
+func splitText(txt string, n int) []string {
+	result := []string{}
+	runes := []rune(strings.TrimSpace(txt))
+	for len(runes) > n {
+		end := n
+		for i := n; i > n/2; i-- {
+			if unicode.IsSpace(runes[i]) {
+				end = i
+				break
+			}
+		}
+
+		if part := strings.TrimSpace(string(runes[:end])); part != "" {
+			result = append(result, part)
+		}
+
+		runes = []rune(strings.TrimLeftFunc(string(runes[end:]), unicode.IsSpace))
+	}
+
+	if len(runes) != 0 {
+		result = append(result, string(runes))
+	}
+
+	return result
+}
+
+// bodyExpector expects a new note body.
+type bodyExpector func(context.Context, string) (string, error)
+
+// bodyExecutor implements the Replier interface.
+var _ Replier = (*bodyExpector)(nil)
+
+// Reply add the new message to the registry and outputs the outcome.
+func (be bodyExpector) Reply(ctx context.Context, u Update) (string, Replier, error) {
+	txt, err := be(ctx, u.Text)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return txt, nil, nil
+}
+
+// documentExpector expects a file and handles other commands as usual.
+type documentExpector struct {
+	next   Replier
+	handle func(context.Context, Document) (string, error)
+}
+
+// documentExpector implements the Replier interface.
+var _ Replier = (*documentExpector)(nil)
+
+// Reply handles the attached file or keeps waiting for one.
+func (de *documentExpector) Reply(ctx context.Context, u Update) (string, Replier, error) {
+	if u.IsCommand {
+		return de.next.Reply(ctx, u)
+	}
+
+	if u.Document == nil {
+		return "Please, send a file or run another command!", de, nil
+	}
+
+	txt, err := de.handle(ctx, *u.Document)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return txt, nil, nil
+}
+
+// queryExpector expects the query of /find and handles the commands and the buttons as usual.
+type queryExpector struct {
+	next Replier
+}
+
+// queryExpector implements the Replier interface.
+var _ Replier = (*queryExpector)(nil)
+
+// Reply searches for the notes matching the message.
+func (qe *queryExpector) Reply(ctx context.Context, u Update) (string, Replier, error) {
+	if _, ok := GetButtonCmd(u.Text); ok || u.IsCommand {
+		return qe.next.Reply(ctx, u)
+	}
+
+	return qe.next.Reply(ctx, Update{
+		IsCommand: true,
+		Cmd:       "find",
+		Args:      strings.Fields(u.Text),
+		Text:      "/find " + u.Text,
+	})
+}
+
+// intentConfirmer runs the interpreted command once the user confirms it.
+type intentConfirmer struct {
+	next Replier
+	cmd  Update
+}
+
+// intentConfirmer implements the Replier interface.
+var _ Replier = (*intentConfirmer)(nil)
+
+// Reply runs the interpreted command on yes, drops it on no and handles the update as usual otherwise.
+func (ic *intentConfirmer) Reply(ctx context.Context, u Update) (string, Replier, error) {
+	switch strings.ToLower(strings.TrimSpace(u.Text)) {
+	case "yes", "y", "ok", "sure":
+		return ic.next.Reply(ctx, ic.cmd)
+	case "no", "n", "nope":
+		return "Okay, never mind!", nil, nil
+	}
+
+	return ic.next.Reply(ctx, u)
+}
+
+// TODO: page long listings with "◀ Prev / Next ▶" inline buttons editing the message in place once callback queries are routed to repliers
+
+// listingTTL is how long the numbers of the last listing can be referred to.
+const listingTTL = 5 * time.Minute
+
+// listingCmds are the commands taking a note ID as the first argument.
+var listingCmds = map[string]bool{
+	"shownote":   true,
+	"deletenote": true,
+	"priority":   true,
+	"sendnote":   true,
+	"emailnote":  true,
+	"publish":    true,
+}
+
+// listing remembers the numbers of the last listing to let commands refer to notes by them
+// and the filter of the listing to let follow-ups like "only #work" narrow it down.
+type listing struct {
+	next    cmdExecer
+	ids     []NoteID
+	filter  *Filter
+	expires time.Time
+}
+
+// listing implements the Replier interface.
+var _ Replier = (*listing)(nil)
+
+// Reply resolves the listing numbers to note IDs and executes the command.
+// Numbers are never taken for note IDs while a listing is remembered, for the listings don't show the IDs.
+func (l *listing) Reply(ctx context.Context, u Update) (string, Replier, error) {
+	n, isNumber := 0, false
+	if u.IsCommand && listingCmds[u.Cmd] && len(u.Args) != 0 {
+		var err error
+		n, err = strconv.Atoi(u.Args[0])
+		isNumber = err == nil
+	}
+
+	if time.Now().After(l.expires) {
+		if isNumber {
+			return fmt.Sprintf("The last listing has expired! Please, list the notes again or refer to the note by its ID, e.g. /%s #%d", u.Cmd, n), nil, nil
+		}
+
+		return l.next.Reply(ctx, u)
+	}
+
+	if l.filter != nil && !u.IsCommand {
+		if r, ok := ParseRefinement(u.Text, time.Now()); ok {
+			return l.next.list(ctx, l.filter.Narrow(r))
+		}
+	}
+
+	if isNumber {
+		if n < 1 || n > len(l.ids) {
+			return fmt.Sprintf("There is no note %d in the last listing, it has %d! Please, refer to other notes by their IDs, e.g. /%s #%d", n, len(l.ids), u.Cmd, n), l, nil
+		}
+
+		u.Args = append([]string{fmt.Sprintf("#%d", l.ids[n-1])}, u.Args[1:]...)
+	}
+
+	txt, next, err := l.next.Reply(ctx, u)
+	if next == nil {
+		next = l
+	}
+
+	return txt, next, err
+}
+
+// createOptions are the options of the createnote command.
+type createOptions struct {
+	Tags     []string
+	Expires  time.Duration
+	Priority Priority
+}
+
+func toCreateOptions(args []string) (createOptions, bool) {
+	var o createOptions
+	var tags, expires string
+	priority := PriorityNormal.String()
+
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.StringVar(&tags, "tag", "", "")
+	fs.StringVar(&expires, "expires", "", "")
+	fs.StringVar(&priority, "priority", priority, "")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		return createOptions{}, false
+	}
+
+	p, ok := ParsePriority(priority)
+	if !ok {
+		return createOptions{}, false
+	}
+
+	o.Priority = p
+
+	if tags != "" {
+		o.Tags = strings.Split(tags, ",")
+	}
+
+	if expires != "" {
+		d, err := parseTTL(expires)
+		if err != nil || d <= 0 {
+			return createOptions{}, false
+		}
+
+		o.Expires = d
+	}
+
+	return o, true
+}
+
+// parseTTL parses durations like 7d on top of the ones time.ParseDuration understands.
+func parseTTL(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+
+	return time.ParseDuration(s)
+}
+
+// listOptions are the options of the listing commands.
+type listOptions struct {
+	Tags       []string
+	Priorities []Priority
+	Count      bool
+	ByPriority bool
+}
+
+func toListOptions(args []string) (listOptions, bool) {
+	var o listOptions
+	var tags, priorities string
+
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.StringVar(&tags, "tag", "", "")
+	fs.StringVar(&priorities, "priority", "", "")
+	fs.BoolVar(&o.Count, "count", false, "")
+	fs.BoolVar(&o.ByPriority, "by-priority", false, "")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		return listOptions{}, false
+	}
+
+	if tags != "" {
+		o.Tags = strings.Split(tags, ",")
+	}
+
+	if priorities != "" {
+		for _, s := range strings.Split(priorities, ",") {
+			p, ok := ParsePriority(s)
+			if !ok {
+				return listOptions{}, false
+			}
+
+			o.Priorities = append(o.Priorities, p)
+		}
+	}
+
+	return o, true
+}
+
+func toNoteID(args []string) (NoteID, bool) {
+	if len(args) != 1 {
+		return 0, false
+	}
+
+	return parseNoteID(args[0])
+}
+
+// parseNoteID parses note IDs like 1 or #1.
+func parseNoteID(s string) (NoteID, bool) {
+	id, err := strconv.Atoi(strings.TrimPrefix(s, "#"))
+	if err != nil {
+		return 0, false
+	}
+
+	return NoteID(id), true
+}
+
+// previewLength is the maximum number of characters of a note shown in listings.
+const previewLength = 64
+
+// snippetContext is the number of characters shown before a match in a snippet.
+const snippetContext = 20
+
+// preview renders the note ID, its tags and the beginning of its first line.
+func preview(e Entry) string {
+	return fmt.Sprintf("%s %s", header(e), snippet(e))
+}
+
+// snippet renders the beginning of the first line of the note.
+func snippet(e Entry) string {
+	txt := strings.SplitN(e.Text, "\n", 2)[0]
+	if runes := []rune(txt); len(runes) > previewLength {
+		txt = string(runes[:previewLength])
+	}
+
+	if txt != e.Text {
+		txt += "…"
+	}
+
+	return txt
+}
+
+// priorityMarkers mark the notes of other than normal priority in listings.
+var priorityMarkers = map[Priority]string{
+	PriorityHigh: "❗",
+	PriorityLow:  "🔽",
+}
+
+// matchSnippet renders the part of the note around the first match of the phrase
+// (or the beginning of the note if there is none) on a single line.
+func matchSnippet(e Entry, phrase string) string {
+	runes := []rune(strings.Join(strings.Fields(e.Text), " "))
+	needle := []rune(strings.ToLower(phrase))
+	lower := []rune(strings.ToLower(string(runes)))
+
+	// Lowering a few characters changes their count, so falling back to the beginning in that case.
+	start := 0
+	if len(lower) == len(runes) {
+		if i := indexRunes(lower, needle); i > snippetContext {
+			start = i - snippetContext
+		}
+	}
+
+	end := start + previewLength
+	if end > len(runes) {
+		end = len(runes)
+	}
+
+	result := string(runes[start:end])
+	if start != 0 {
+		result = "…" + result
+	}
+
+	if end != len(runes) {
+		result += "…"
+	}
+
+	return result
+}
+
+// indexRunes returns the index of the first occurrence of the needle in the runes, -1 if there is none.
+func indexRunes(runes, needle []rune) int {
+	for i := 0; i+len(needle) <= len(runes); i++ {
+		if string(runes[i:i+len(needle)]) == string(needle) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// header renders the note ID, its tags and when it expires.
+func header(e Entry) string {
+	return fmt.Sprintf("#%d", e.ID) + labels(e)
+}
+
+// labels render the priority, the tags, the sender and the expiry of the note, each after a space.
+func labels(e Entry) string {
+	result := ""
+	if marker, ok := priorityMarkers[e.Priority]; ok {
+		result += " " + marker
+	}
+
+	if len(e.Tags) != 0 {
+		result += fmt.Sprintf(" [%s]", strings.Join(e.Tags, ", "))
+	}
+
+	if e.SharedBy != "" {
+		result += fmt.Sprintf(" (from %s)", e.SharedBy)
+	}
+
+	if !e.Expires.IsZero() {
+		result += fmt.Sprintf(" (expires %s)", e.Expires.Format("2006-01-02 15:04"))
+	}
+
+	return result
+}
+
+// cmd/cmd.go
+// cmd/createnote.go
+// cmd/listnotest.go
+
+// TODO: clear all DB data at some point
+
+// TODO: use cobra or something for commands
+
+// TODO: attach snooze (1h, tomorrow) and done inline buttons to fired reminders once reminders and callback routing exist
+
+// TODO: add /reminders and /cancelreminder once there is a reminder store with list and delete operations
+
+// TODO: add /schedule <id> <time> [chat] with its own list and cancel commands, posting through the Messenger, once the reminder scheduler exists
+
+// TODO: mirror reminders into Google Calendar (OAuth token storage, cancellation both ways) once reminders exist
+
+// TODO: add /export pdf [--tag x] once there is a PDF typesetting library and replies can carry documents
+
+// TODO: add /history of the last 20 actions with /shownote links once there is an audit log of the commands and the touched notes
+
+// TODO: add /tagcloud rendering the tag frequencies into an image once there is a font rendering library and replies can carry photos
+
+// CmdID is an ID of a Telegram command.
+type CmdID string
+
+// TODO: drop it in favor of registering per file
+
+var Cmds []Cmd = []Cmd{
+	{
+		ID:     "createnote",
+		Usage:  "/createnote [--tag work,concentration] [--expires 7d] [--priority high]",
+		Button: "New note",
+	},
+	{
+		ID:     "listnotes",
+		Usage:  "/listnotes [--tag work] [--priority high,normal] [--by-priority] [--count]",
+		Button: "List",
+	},
+	{
+		ID:     "find",
+		Usage:  `/find tag:work -tag:archived "quarterly report" after:2024-01-01 before:2024-06-01 [--count]`,
+		Button: "Search",
+	},
+	{
+		ID:    "recent",
+		Usage: "/recent [5]",
+	},
+	{
+		ID:    "today",
+		Usage: "/today",
+	},
+	{
+		ID:    "onthisday",
+		Usage: "/onthisday",
+	},
+	{
+		ID:    "shownote",
+		Usage: "/shownote 1",
+	},
+	{
+		ID:    "deletenote",
+		Usage: "/deletenote 1",
+	},
+	{
+		ID:    "priority",
+		Usage: "/priority 1 high",
+	},
+	{
+		ID:    "sendnote",
+		Usage: "/sendnote 1 @username",
+	},
+	{
+		ID:    "emailnote",
+		Usage: "/emailnote 1 someone@example.com",
+	},
+	{
+		ID:    "publish",
+		Usage: "/publish 1",
+	},
+	{
+		ID:    "acceptnote",
+		Usage: "/acceptnote 1",
+	},
+	{
+		ID:    "import",
+		Usage: "/import",
+	},
+	{
+		ID:    "feed",
+		Usage: "/feed [work]",
+	},
+	{
+		ID:     "keyboard",
+		Usage:  "/keyboard [on|off]",
+		Button: "Hide keyboard",
+	},
+	{
+		ID:    "setwebhook",
+		Usage: "/setwebhook https://example.com/hook",
+	},
+	{
+		ID:    "unsetwebhook",
+		Usage: "/unsetwebhook",
+	},
+	{
+		ID:    "channelnotes",
+		Usage: "/channelnotes @channel [--tag work]",
+	},
+	{
+		ID:    "sharetag",
+		Usage: "/sharetag work",
+	},
+	{
+		ID:    "unsharetag",
+		Usage: "/unsharetag 0123456789abcdef",
+	},
+}
+
+// Cmd describes a Telegram command.
+type Cmd struct {
+	ID    string
+	Usage string
+	// Button is the label of the command on the reply keyboard, empty if it's not there.
+	Button string
+}
+
+// GetUsage returns usage of all the Telegram commands.
+func GetUsage() string {
+	result := []string{}
+	for _, cmd := range Cmds {
+		result = append(result, cmd.Usage)
+	}
+
+	return fmt.Sprintf(`Run one of
+
+%s
+
+to let the magic happen!
+`, strings.Join(result, "\n"))
+}
+
+// AdminCmds are the commands available only to the admins as /admin subcommands.
+var AdminCmds []Cmd = []Cmd{
+	{
+		ID:    "setmaxnotes",
+		Usage: "/admin setmaxnotes 123 1000",
+	},
+	{
+		ID:    "maintenance",
+		Usage: "/admin maintenance on|off [Back in an hour!]",
+	},
+	{
+		ID:    "broadcast",
+		Usage: "/admin broadcast We'll be down tonight!|abort",
+	},
+	{
+		ID:    "stats",
+		Usage: "/admin stats",
+	},
+	{
+		ID:    "deadletters",
+		Usage: "/admin deadletters",
+	},
+	{
+		ID:    "replay",
+		Usage: "/admin replay 1 [force]",
+	},
+	{
+		ID:    "dropdeadletter",
+		Usage: "/admin dropdeadletter 1",
+	},
+}
+
+// GetAdminUsage returns usage of all the admin commands.
+func GetAdminUsage() string {
+	result := []string{}
+	for _, cmd := range AdminCmds {
+		result = append(result, cmd.Usage)
+	}
+
+	return fmt.Sprintf(`Run one of
+
+%s
+
+to administer the bot!
+`, strings.Join(result, "\n"))
+}
+
+// keyboardWidth is the number of buttons in a row of the reply keyboard.
+const keyboardWidth = 2
+
+// GetKeyboard returns the labels of the reply keyboard buttons by rows.
+func GetKeyboard() [][]string {
+	result := [][]string{}
+	row := []string{}
+	for _, cmd := range Cmds {
+		if cmd.Button == "" {
+			continue
+		}
+
+		row = append(row, cmd.Button)
+		if len(row) == keyboardWidth {
+			result = append(result, row)
+			row = []string{}
+		}
+	}
+
+	if len(row) != 0 {
+		result = append(result, row)
+	}
+
+	return result
+}
+
+// GetButtonCmd returns the ID of the command with the given reply keyboard button.
+func GetButtonCmd(label string) (string, bool) {
+	for _, cmd := range Cmds {
+		if cmd.Button != "" && cmd.Button == label {
+			return cmd.ID, true
+		}
+	}
+
+	return "", false
+}
+
+// GetCmdUsage returns usage of the given Telegram command.
+func GetCmdUsage(id string) string {
+	for _, cmd := range Cmds {
+		if cmd.ID == id {
+			return cmd.Usage
+		}
+	}
+
+	return ""
+}
+
+// prototype/admin.go
+
+// isAdmin checks whether the user is allowed to run the admin commands.
+func (ce cmdExecer) isAdmin() bool {
+	return isAdmin(ce.services.Admins, ce.uid)
+}
+
+// isAdmin checks whether the user is among the admins.
+func isAdmin(admins []UserID, uid UserID) bool {
+	for _, admin := range admins {
+		if admin == uid {
+			return true
+		}
+	}
+
+	return false
+}
+
+// admin executes an admin command.
+func (ce cmdExecer) admin(ctx context.Context, args []string) (string, Replier, error) {
+	if len(args) == 0 {
+		return GetAdminUsage(), nil, nil
+	}
+
+	if args[0] == "setmaxnotes" {
+		if len(args) != 3 {
+			return "Please, run it as /admin setmaxnotes 123 1000", nil, nil
+		}
+
+		uid, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Sprintf("%q is not a user ID!", args[1]), nil, nil
+		}
+
+		max, err := strconv.Atoi(args[2])
+		if err != nil || max < 0 {
+			return fmt.Sprintf("%q is not a number of notes!", args[2]), nil, nil
+		}
+
+		ce.services.Quotas.SetMaxNotes(UserID(uid), max)
+
+		return fmt.Sprintf("User %d can store up to %d notes now!", uid, max), nil, nil
+	}
+
+	if args[0] == "maintenance" {
+		if len(args) < 2 || (args[1] != "on" && args[1] != "off") || (args[1] == "off" && len(args) > 2) {
+			return "Please, run it as /admin maintenance on|off [Back in an hour!]", nil, nil
+		}
+
+		on := args[1] == "on"
+		ce.services.Maintenance.SetMaintenance(on, strings.Join(args[2:], " "))
+		if !on {
+			return "The maintenance is over! Everyone is welcome again.", nil, nil
+		}
+
+		message, _ := ce.services.Maintenance.Maintenance()
+
+		return fmt.Sprintf("The bot is under maintenance now! The users see:\n\n%s", message), nil, nil
+	}
+
+	if args[0] == "broadcast" {
+		b := ce.services.Broadcaster
+		if len(args) == 1 {
+			sent, total, running := b.BroadcastProgress()
+			if !running {
+				return "No broadcast is running! Please, run it as /admin broadcast We'll be down tonight!", nil, nil
+			}
+
+			return fmt.Sprintf("The broadcast is sent to %d users of %d so far. Run /admin broadcast abort to stop it.", sent, total), nil, nil
+		}
+
+		if len(args) == 2 && args[1] == "abort" {
+			if !b.AbortBroadcast() {
+				return "No broadcast is running!", nil, nil
+			}
+
+			return "Aborting the broadcast!", nil, nil
+		}
+
+		to := ce.services.Users.ListUsers()
+		if !b.StartBroadcast(ce.uid, strings.Join(args[1:], " "), to) {
+			return "Another broadcast is running! Please, wait for it or run /admin broadcast abort.", nil, nil
+		}
+
+		return fmt.Sprintf("Broadcasting to %d users! Run /admin broadcast to see the progress.", len(to)), nil, nil
+	}
+
+	if args[0] == "stats" {
+		if ce.services.Stats == nil {
+			return "Usage stats are disabled on this bot! :(", nil, nil
+		}
+
+		counts := ce.services.Stats.CommandCounts()
+		if len(counts) == 0 {
+			return "No commands were run yet!", nil, nil
+		}
+
+		cmds := []string{}
+		for cmd := range counts {
+			cmds = append(cmds, cmd)
+		}
+
+		sort.Slice(cmds, func(i, j int) bool {
+			if counts[cmds[i]] != counts[cmds[j]] {
+				return counts[cmds[i]] > counts[cmds[j]]
+			}
+
+			return cmds[i] < cmds[j]
+		})
+
+		result := []string{}
+		for _, cmd := range cmds {
+			result = append(result, fmt.Sprintf("/%s: %d", cmd, counts[cmd]))
+		}
+
+		return strings.Join(result, "\n"), nil, nil
+	}
+
+	if args[0] == "deadletters" {
+		letters := ce.services.DeadLetters.ListDeadLetters()
+		if len(letters) == 0 {
+			return "No dead letters! Hooray!", nil, nil
+		}
+
+		result := []string{}
+		for _, l := range letters {
+			result = append(result, fmt.Sprintf("%d. %s from user %d: %q failed with %s", l.ID, l.Time.Format("2006-01-02 15:04"), l.UserID, l.Update.Text, l.Err))
+		}
+
+		return strings.Join(result, "\n\n"), nil, nil
+	}
+
+	if args[0] == "replay" || args[0] == "dropdeadletter" {
+		force := args[0] == "replay" && len(args) == 3 && args[2] == "force"
+		if len(args) != 2 && !force {
+			return "Please, run it as /admin " + args[0] + " 1", nil, nil
+		}
+
+		id, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Sprintf("%q is not a dead letter ID!", args[1]), nil, nil
+		}
+
+		// The writes are not idempotent, so the admin checks the notes before replaying them.
+		if !force {
+			for _, l := range ce.services.DeadLetters.ListDeadLetters() {
+				if l.ID == id && args[0] == "replay" && !isReadOnly(l.Update) {
+					return fmt.Sprintf("Dead letter %d might have changed the notes of user %d before failing! Please, make sure replaying it doesn't duplicate anything and run /admin replay %d force", id, l.UserID, id), nil, nil
+				}
+			}
+		}
+
+		l, ok := ce.services.DeadLetters.TakeDeadLetter(id)
+		if !ok {
+			return fmt.Sprintf("There is no dead letter %d! :(", id), nil, nil
+		}
+
+		if args[0] == "dropdeadletter" {
+			return fmt.Sprintf("Successfully dropped dead letter %d!", id), nil, nil
+		}
+
+		return ce.replay(ctx, l)
+	}
+
+	return GetAdminUsage(), nil, nil
+}
+
+// replay handles the dead letter again by the replier that failed and sends the reply to the user.
+// The conversation the replier might continue is dropped, for the user has moved on.
+func (ce cmdExecer) replay(ctx context.Context, l DeadLetter) (string, Replier, error) {
+	txt, _, err := l.Replier.Reply(ctx, l.Update)
+	if err != nil {
+		l.Err = err.Error()
+		l.Time = time.Now()
+		id := ce.services.DeadLetters.AddDeadLetter(l)
+
+		return fmt.Sprintf("The replay failed with %v! It's dead letter %d now.", err, id), nil, nil
+	}
+
+	if err := ce.services.Messenger.SendMessage(ctx, l.UserID, fmt.Sprintf("Sorry for the delay! Here is the reply to %q:\n\n%s", l.Update.Text, txt)); err != nil {
+		return "", nil, err
+	}
+
+	return fmt.Sprintf("Successfully replayed dead letter %d! The reply is sent to user %d.", l.ID, l.UserID), nil, nil
+}
+
+// importer/importer.go
+
+// Importer converts an export of another app into notes.
+type Importer func(data []byte) ([]Entry, error)
+
+// importers are the importers by the extension of the export file.
+var importers = map[string]Importer{
+	".enex": ParseENEX,
+	".zip":  ParseKeepArchive,
+	".json": ParseKeepNote,
+}
+
+// importerFor returns the importer for the export file.
+func importerFor(name string) (Importer, bool) {
+	i, ok := importers[strings.ToLower(filepath.Ext(name))]
+
+	return i, ok
+}
+
+// importFormats lists the extensions of the supported export files.
+func importFormats() string {
+	result := []string{}
+	for ext := range importers {
+		result = append(result, ext)
+	}
+
+	sort.Strings(result)
+
+	return strings.Join(result, ", ")
+}
+
+// toTag makes a tag out of a label of another app.
+func toTag(label string) string {
+	return strings.Join(strings.FieldsFunc(label, func(r rune) bool {
+		return unicode.IsSpace(r) || r == ','
+	}), "_")
+}
+
+// importer/enex.go
+
+// enexTimeLayout is the layout of the dates in Evernote exports.
+const enexTimeLayout = "20060102T150405Z"
+
+// enexExport is an Evernote export.
+type enexExport struct {
+	Notes []struct {
+		Title   string   `xml:"title"`
+		Content string   `xml:"content"`
+		Created string   `xml:"created"`
+		Tags    []string `xml:"tag"`
+	} `xml:"note"`
+}
+
+// ParseENEX converts an Evernote export (.enex) into notes, stripping ENML to text.
+func ParseENEX(data []byte) ([]Entry, error) {
+	var export enexExport
+	if err := xml.Unmarshal(data, &export); err != nil {
+		return nil, err
+	}
+
+	result := []Entry{}
+	for _, n := range export.Notes {
+		body, err := enmlToText(n.Content)
+		if err != nil {
+			return nil, fmt.Errorf("note %q: %w", n.Title, err)
+		}
+
+		e := Entry{
+			Text: strings.TrimSpace(n.Title + "\n\n" + body),
+		}
+
+		for _, t := range n.Tags {
+			if t = toTag(t); t != "" {
+				e.Tags = append(e.Tags, t)
+			}
+		}
+
+		if created, err := time.Parse(enexTimeLayout, n.Created); err == nil {
+			e.Created = created
+		}
+
+		result = append(result, e)
+	}
+
+	return result, nil
+}
+
+// enmlBlocks are the ENML elements starting a new line.
+var enmlBlocks = map[string]bool{
+	"br": true, "div": true, "p": true, "li": true, "tr": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+}
+
+// enmlToText keeps the text of the ENML document, one line per block.
+func enmlToText(enml string) (string, error) {
+	d := xml.NewDecoder(strings.NewReader(enml))
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+
+	var b strings.Builder
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+
+		switch t := t.(type) {
+		case xml.StartElement:
+			if t.Name.Local == "en-todo" {
+				b.WriteString("[ ] ")
+			}
+		case xml.EndElement:
+			if enmlBlocks[t.Name.Local] {
+				b.WriteString("\n")
+			}
+		case xml.CharData:
+			b.Write(t)
+		}
+	}
+
+	lines := []string{}
+	for _, l := range strings.Split(b.String(), "\n") {
+		lines = append(lines, strings.TrimSpace(l))
+	}
+
+	return strings.TrimSpace(strings.Join(lines, "\n")), nil
+}
+
+// importer/keep.go
+
+// keepNote is a note in a Google Keep Takeout archive.
+type keepNote struct {
+	Title       string `json:"title"`
+	TextContent string `json:"textContent"`
+	ListContent []struct {
+		Text      string `json:"text"`
+		IsChecked bool   `json:"isChecked"`
+	} `json:"listContent"`
+	Labels []struct {
+		Name string `json:"name"`
+	} `json:"labels"`
+	CreatedTimestampUsec int64 `json:"createdTimestampUsec"`
+	IsTrashed            bool  `json:"isTrashed"`
+}
+
+// keepTodoTag marks the notes made of Keep checklists.
+const keepTodoTag = "todo"
+
+// maxKeepNoteSize is the size of the largest note file read from an archive.
+const maxKeepNoteSize = 1 << 20
+
+// maxKeepArchiveSize is the total size of the note files read from an archive.
+const maxKeepArchiveSize = 64 << 20
+
+// ErrArchiveTooLarge is returned for an archive unpacking to more than the bot reads.
+var ErrArchiveTooLarge = errors.New("archive is too large")
+
+// ParseKeepArchive converts a Google Keep Takeout archive (.zip) into notes.
+func ParseKeepArchive(data []byte) ([]Entry, error) {
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+
+	result := []Entry{}
+	total := 0
+	for _, f := range r.File {
+		if !strings.Contains(f.Name, "Keep/") || !strings.HasSuffix(f.Name, ".json") {
+			continue
+		}
+
+		// Checking the declared sizes first and the actual ones while reading, for they may lie.
+		if f.UncompressedSize64 > maxKeepNoteSize {
+			return nil, fmt.Errorf("%s: %w", f.Name, ErrArchiveTooLarge)
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := io.ReadAll(io.LimitReader(rc, maxKeepNoteSize+1))
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		total += len(b)
+		if len(b) > maxKeepNoteSize || total > maxKeepArchiveSize {
+			return nil, fmt.Errorf("%s: %w", f.Name, ErrArchiveTooLarge)
+		}
+
+		entries, err := ParseKeepNote(b)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f.Name, err)
+		}
+
+		result = append(result, entries...)
+	}
+
+	return result, nil
+}
+
+// ParseKeepNote converts a single Google Keep note (.json) from Takeout into a note,
+// skipping it if it's trashed. Checklists become todo notes.
+func ParseKeepNote(data []byte) ([]Entry, error) {
+	var n keepNote
+	if err := json.Unmarshal(data, &n); err != nil {
+		return nil, err
+	}
+
+	if n.IsTrashed {
+		return []Entry{}, nil
+	}
+
+	lines := []string{n.Title, n.TextContent}
+	for _, item := range n.ListContent {
+		mark := "[ ]"
+		if item.IsChecked {
+			mark = "[x]"
+		}
+
+		lines = append(lines, mark+" "+item.Text)
+	}
+
+	e := Entry{
+		Text: strings.TrimSpace(strings.Join(lines, "\n")),
+	}
+
+	for _, l := range n.Labels {
+		if t := toTag(l.Name); t != "" {
+			e.Tags = append(e.Tags, t)
+		}
+	}
+
+	if len(n.ListContent) != 0 && !hasTag(e, keepTodoTag) {
+		e.Tags = append(e.Tags, keepTodoTag)
+	}
+
+	if n.CreatedTimestampUsec != 0 {
+		e.Created = time.UnixMicro(n.CreatedTimestampUsec)
+	}
+
+	if e.Text == "" {
+		return []Entry{}, nil
+	}
+
+	return []Entry{e}, nil
+}
+
+// intent/rules.go
+
+// NewRuleIntentParser creates an intent parser recognizing a few common phrasings.
+func NewRuleIntentParser() IntentParser {
+	return ruleIntentParser{
+		now: time.Now,
+	}
+}
+
+type ruleIntentParser struct {
+	now func() time.Time
+}
+
+// ruleIntentParser implements the IntentParser interface.
+var _ IntentParser = ruleIntentParser{}
+
+// ParseIntent turns messages like "show me everything about work from last week" into commands.
+func (rp ruleIntentParser) ParseIntent(ctx context.Context, txt string) (Update, bool, error) {
+	words := strings.FieldsFunc(strings.ToLower(txt), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '#' && r != '-'
+	})
+
+	today := startOfDay(rp.now())
+	cmd := "find"
+	args := []string{}
+	for i := 0; i < len(words); i++ {
+		w, next := words[i], ""
+		if i+1 < len(words) {
+			next = words[i+1]
+		}
+
+		switch {
+		case strings.HasPrefix(w, "#") && len(w) > 1:
+			args = append(args, "tag:"+w[1:])
+		case (w == "about" || w == "tagged") && next != "":
+			args = append(args, "tag:"+strings.TrimPrefix(next, "#"))
+			i++
+		case (w == "containing" || w == "mentioning") && next != "":
+			args = append(args, next)
+			i++
+		case w == "today":
+			args = append(args, "after:"+today.Format(dateLayout))
+		case w == "yesterday":
+			args = append(args, "after:"+today.AddDate(0, 0, -1).Format(dateLayout), "before:"+today.Format(dateLayout))
+		case (w == "last" || w == "past" || w == "this") && next == "week":
+			args = append(args, "after:"+today.AddDate(0, 0, -7).Format(dateLayout))
+			i++
+		case (w == "last" || w == "past" || w == "this") && next == "month":
+			args = append(args, "after:"+today.AddDate(0, -1, 0).Format(dateLayout))
+			i++
+		case (w == "last" || w == "past" || w == "this") && next == "year":
+			args = append(args, "after:"+today.AddDate(-1, 0, 0).Format(dateLayout))
+			i++
+		case (w == "show" || w == "delete" || w == "remove") && next == "note" && i+2 < len(words):
+			if _, err := strconv.Atoi(words[i+2]); err == nil {
+				cmd = map[string]string{"show": "shownote", "delete": "deletenote", "remove": "deletenote"}[w]
+				args = []string{"#" + words[i+2]}
+				i = len(words)
+			}
+		}
+	}
+
+	if len(args) == 0 {
+		return Update{}, false, nil
+	}
+
+	return Update{
+		IsCommand: true,
+		Cmd:       cmd,
+		Args:      args,
+		Text:      fmt.Sprintf("/%s %s", cmd, strings.Join(args, " ")),
+	}, true, nil
+}
+
+// prototype/quotas.go
+
+// NewQuotas creates quotas with the given default maximum number of notes.
+func NewQuotas(maxNotes int) Quotas {
+	return &quotas{
+		maxNotes: maxNotes,
+		repo:     map[UserID]int{},
+	}
+}
+
+type quotas struct {
+	sync.RWMutex
+	maxNotes int
+	repo     map[UserID]int
+}
+
+// quotas implements the Quotas interface.
+var _ Quotas = (*quotas)(nil)
+
+// MaxNotes returns the maximum number of notes of the user, 0 means no limit.
+func (q *quotas) MaxNotes(uid UserID) int {
+	q.RLock()
+	defer q.RUnlock()
+
+	if max, ok := q.repo[uid]; ok {
+		return max
+	}
+
+	return q.maxNotes
+}
+
+// SetMaxNotes overrides the maximum number of notes of the user.
+func (q *quotas) SetMaxNotes(uid UserID, max int) {
+	q.Lock()
+	defer q.Unlock()
+
+	q.repo[uid] = max
+}
+
+// prototype/maintenance.go
+
+// NewMaintenance creates the maintenance switch, off, with the default message for the users.
+func NewMaintenance(message string) Maintenance {
+	return &maintenance{
+		defaultMessage: message,
+	}
+}
+
+type maintenance struct {
+	sync.RWMutex
+	defaultMessage string
+	message        string
+	on             bool
+}
+
+// maintenance implements the Maintenance interface.
+var _ Maintenance = (*maintenance)(nil)
+
+// SetMaintenance turns the maintenance on or off.
+func (m *maintenance) SetMaintenance(on bool, message string) {
+	m.Lock()
+	defer m.Unlock()
+
+	if message == "" {
+		message = m.defaultMessage
+	}
+
+	m.on = on
+	m.message = message
+}
+
+// Maintenance returns the message for the users if the maintenance is on.
+func (m *maintenance) Maintenance() (string, bool) {
+	m.RLock()
+	defer m.RUnlock()
+
+	return m.message, m.on
+}
+
+// maintenanceReplier answers with the maintenance message and keeps the pending conversation for later.
+type maintenanceReplier struct {
+	message string
+	pending Replier
+}
+
+// maintenanceReplier implements the Replier interface.
+var _ Replier = (*maintenanceReplier)(nil)
+
+// Reply answers with the maintenance message.
+func (mr *maintenanceReplier) Reply(ctx context.Context, u Update) (string, Replier, error) {
+	return mr.message, mr.pending, nil
+}
+
+// prototype/usage_stats.go
+
+// NewUsageStats creates the usage stats counting from zero.
+func NewUsageStats() UsageStats {
+	return &usageStats{
+		repo: map[string]int{},
+	}
+}
+
+type usageStats struct {
+	sync.RWMutex
+	repo map[string]int
+}
+
+// usageStats implements the UsageStats interface.
+var _ UsageStats = (*usageStats)(nil)
+
+// CountCommand counts one more run of the command.
+func (us *usageStats) CountCommand(cmd string) {
+	us.Lock()
+	defer us.Unlock()
+
+	us.repo[cmd]++
+}
+
+// CommandCounts returns the number of runs by the command.
+func (us *usageStats) CommandCounts() map[string]int {
+	us.RLock()
+	defer us.RUnlock()
+
+	result := map[string]int{}
+	for cmd, n := range us.repo {
+		result[cmd] = n
+	}
+
+	return result
+}
+
+// prototype/share_repository.go
+
+// NewShareRepository creates a share repository.
+func NewShareRepository() ShareRepository {
+	return &shareRepository{
+		repo: map[string]Share{},
+	}
+}
+
+type shareRepository struct {
+	sync.RWMutex
+	repo map[string]Share
+}
+
+// shareRepository implements the ShareRepository interface.
+var _ ShareRepository = (*shareRepository)(nil)
+
+// CreateShare generates a new token for the share.
+func (sr *shareRepository) CreateShare(s Share) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+
+	sr.Lock()
+	defer sr.Unlock()
+
+	sr.repo[token] = s
+
+	return token, nil
+}
+
+// ProvideShare returns the share granted by the token.
+func (sr *shareRepository) ProvideShare(token string) (Share, bool) {
+	sr.RLock()
+	defer sr.RUnlock()
+
+	s, ok := sr.repo[token]
+
+	return s, ok
+}
+
+// DeleteShare revokes the token if it belongs to the user.
+func (sr *shareRepository) DeleteShare(uid UserID, token string) bool {
+	sr.Lock()
+	defer sr.Unlock()
+
+	if s, ok := sr.repo[token]; !ok || s.UserID != uid {
+		return false
+	}
+
+	delete(sr.repo, token)
+
+	return true
+}
+
+// newToken generates a random hard-to-guess token.
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// prototype/user_directory.go
+
+// NewUserDirectory creates a user directory.
+func NewUserDirectory() UserDirectory {
+	return &userDirectory{
+		ids:   map[string]UserID{},
+		names: map[UserID]string{},
+	}
+}
+
+type userDirectory struct {
+	sync.RWMutex
+	ids   map[string]UserID
+	names map[UserID]string
+}
+
+// userDirectory implements the UserDirectory interface.
+var _ UserDirectory = (*userDirectory)(nil)
+
+// SaveUser remembers the user and their username if there is one.
+func (ud *userDirectory) SaveUser(uid UserID, username string) {
+	ud.Lock()
+	defer ud.Unlock()
+
+	if _, ok := ud.names[uid]; !ok || username != "" {
+		ud.names[uid] = username
+	}
+
+	if username != "" {
+		ud.ids[strings.ToLower(username)] = uid
+	}
+}
+
+// FindUser returns the user with the given username, with or without the @.
+func (ud *userDirectory) FindUser(username string) (UserID, bool) {
+	ud.RLock()
+	defer ud.RUnlock()
+
+	uid, ok := ud.ids[strings.ToLower(strings.TrimPrefix(username, "@"))]
+
+	return uid, ok
+}
+
+// UserName returns the @username of the user or their ID if it's unknown.
+func (ud *userDirectory) UserName(uid UserID) string {
+	ud.RLock()
+	defer ud.RUnlock()
+
+	if name := ud.names[uid]; name != "" {
+		return "@" + name
+	}
+
+	return fmt.Sprintf("user %d", uid)
+}
+
+// prototype/keyboards.go
+
+// NewKeyboards creates the keyboard settings with the keyboard hidden for everyone.
+func NewKeyboards() Keyboards {
+	return &keyboards{
+		repo:    map[UserID]bool{},
+		changed: map[UserID]bool{},
+	}
+}
+
+type keyboards struct {
+	sync.RWMutex
+	repo    map[UserID]bool
+	changed map[UserID]bool
+}
+
+// keyboards implements the Keyboards interface.
+var _ Keyboards = (*keyboards)(nil)
+
+// SetKeyboard shows or hides the keyboard of the user.
+func (k *keyboards) SetKeyboard(uid UserID, on bool) {
+	k.Lock()
+	defer k.Unlock()
+
+	if k.repo[uid] != on {
+		k.changed[uid] = true
+	}
+
+	k.repo[uid] = on
+}
+
+// Keyboard tells whether the user wants the keyboard.
+func (k *keyboards) Keyboard(uid UserID) bool {
+	k.RLock()
+	defer k.RUnlock()
+
+	return k.repo[uid]
+}
+
+// TakeKeyboardChange tells whether the keyboard was toggled since the last call.
+func (k *keyboards) TakeKeyboardChange(uid UserID) bool {
+	k.Lock()
+	defer k.Unlock()
+
+	changed := k.changed[uid]
+	delete(k.changed, uid)
+
+	return changed
+}
+
+// ListUsers returns all the users who talked to the bot.
+func (ud *userDirectory) ListUsers() []UserID {
+	ud.RLock()
+	defer ud.RUnlock()
+
+	result := []UserID{}
+	for uid := range ud.names {
+		result = append(result, uid)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i] < result[j]
+	})
+
+	return result
+}
+
+// prototype/broadcaster.go
+
+// broadcastInterval is the pause between the messages of a broadcast, so that it doesn't crowd out the replies.
+const broadcastInterval = 100 * time.Millisecond
+
+// NewBroadcaster creates a broadcaster sending through the messenger until the context is done.
+func NewBroadcaster(ctx context.Context, m Messenger) Broadcaster {
+	return &broadcaster{
+		ctx:       ctx,
+		messenger: m,
+	}
+}
+
+type broadcaster struct {
+	sync.Mutex
+	ctx       context.Context
+	messenger Messenger
+	sent      int
+	total     int
+	running   bool
+	abort     context.CancelFunc
+}
+
+// broadcaster implements the Broadcaster interface.
+var _ Broadcaster = (*broadcaster)(nil)
+
+// StartBroadcast sends the text to the users in the background and reports to the requester once it's over.
+func (b *broadcaster) StartBroadcast(requester UserID, text string, to []UserID) bool {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.running {
+		return false
+	}
+
+	ctx, abort := context.WithCancel(b.ctx)
+	b.sent, b.total, b.running, b.abort = 0, len(to), true, abort
+
+	go func() {
+		defer abort()
+
+		for _, uid := range to {
+			if err := b.messenger.SendMessage(ctx, uid, text); err != nil {
+				log.Printf("Failed to broadcast to user %d: %v", uid, err)
+			}
+
+			b.Lock()
+			b.sent++
+			b.Unlock()
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(broadcastInterval):
+			}
+
+			if ctx.Err() != nil {
+				break
+			}
+		}
+
+		b.Lock()
+		sent, total := b.sent, b.total
+		b.running = false
+		b.Unlock()
+
+		report := fmt.Sprintf("The broadcast is over! It was sent to %d users of %d.", sent, total)
+		if err := b.messenger.SendMessage(b.ctx, requester, report); err != nil {
+			log.Printf("Failed to report the broadcast to user %d: %v", requester, err)
+		}
+	}()
+
+	return true
+}
+
+// BroadcastProgress tells how the last broadcast goes.
+func (b *broadcaster) BroadcastProgress() (int, int, bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	return b.sent, b.total, b.running
+}
+
+// AbortBroadcast stops the running broadcast.
+func (b *broadcaster) AbortBroadcast() bool {
+	b.Lock()
+	defer b.Unlock()
+
+	if !b.running {
+		return false
+	}
+
+	b.abort()
+
+	return true
+}
+
+// prototype/inbox.go
+
+// NewInbox creates an inbox.
+func NewInbox() Inbox {
+	return &inbox{
+		repo: map[UserID]map[int]Entry{},
+		last: map[UserID]int{},
+	}
+}
+
+type inbox struct {
+	sync.Mutex
+	repo map[UserID]map[int]Entry
+	last map[UserID]int
+}
+
+// inbox implements the Inbox interface.
+var _ Inbox = (*inbox)(nil)
+
+// Deliver puts the note into the inbox of the user.
+func (i *inbox) Deliver(uid UserID, e Entry) int {
+	i.Lock()
+	defer i.Unlock()
+
+	if i.repo[uid] == nil {
+		i.repo[uid] = map[int]Entry{}
+	}
+
+	i.last[uid]++
+	i.repo[uid][i.last[uid]] = e
+
+	return i.last[uid]
+}
+
+// Take removes the note from the inbox of the user.
+func (i *inbox) Take(uid UserID, n int) (Entry, bool) {
+	i.Lock()
+	defer i.Unlock()
+
+	e, ok := i.repo[uid][n]
+	delete(i.repo[uid], n)
+
+	return e, ok
+}
+
+// prototype/dead_letters.go
+
+// maxDeadLetters is the number of the dead letters kept, the oldest ones are dropped.
+const maxDeadLetters = 100
+
+// NewDeadLetters creates a dead-letter store.
+func NewDeadLetters() DeadLetters {
+	return &deadLetters{}
+}
+
+type deadLetters struct {
+	sync.Mutex
+	repo   []DeadLetter
+	lastID int
+}
+
+// deadLetters implements the DeadLetters interface.
+var _ DeadLetters = (*deadLetters)(nil)
+
+// AddDeadLetter keeps the dead letter under a new ID.
+func (dl *deadLetters) AddDeadLetter(l DeadLetter) int {
+	dl.Lock()
+	defer dl.Unlock()
+
+	dl.lastID++
+	l.ID = dl.lastID
+	dl.repo = append(dl.repo, l)
+	if len(dl.repo) > maxDeadLetters {
+		dl.repo = dl.repo[len(dl.repo)-maxDeadLetters:]
+	}
+
+	return l.ID
+}
+
+// ListDeadLetters returns the dead letters from the oldest.
+func (dl *deadLetters) ListDeadLetters() []DeadLetter {
+	dl.Lock()
+	defer dl.Unlock()
+
+	return append([]DeadLetter{}, dl.repo...)
+}
+
+// TakeDeadLetter removes the dead letter.
+func (dl *deadLetters) TakeDeadLetter(id int) (DeadLetter, bool) {
+	dl.Lock()
+	defer dl.Unlock()
+
+	for i, l := range dl.repo {
+		if l.ID == id {
+			dl.repo = append(dl.repo[:i], dl.repo[i+1:]...)
+			return l, true
+		}
+	}
+
+	return DeadLetter{}, false
+}
+
+// prototype/db_provider.go
+
+// TODO: consider moving it to core or something (with the injected DB creator)
+
+func NewDBProvider() DBProvider {
+	return &dbProvider{
+		repo: map[UserID]DB{},
+	}
+}
+
+type dbProvider struct {
+	sync.RWMutex
+	repo map[UserID]DB
+}
+
+// dbProvider implements the DBProvider interface.
+var _ DBProvider = (*dbProvider)(nil)
+
+// ProvideDB returns a prototype DB for a given user.
+func (dbp *dbProvider) ProvideDB(uid UserID) DB {
+	if db := dbp.getDB(uid); db != nil {
+		return db
+	}
+
+	dbp.Lock()
+	defer dbp.Unlock()
+
+	db := NewDB()
+
+	dbp.repo[uid] = db
+
+	return db
+}
+
+// ListUsers returns the users having a prototype DB.
+func (dbp *dbProvider) ListUsers() []UserID {
+	dbp.RLock()
+	defer dbp.RUnlock()
+
+	result := []UserID{}
+	for uid := range dbp.repo {
+		result = append(result, uid)
+	}
+
+	return result
+}
+
+// getDB safely returns a DB from the provider.
+func (dbp *dbProvider) getDB(uid UserID) DB {
+	dbp.RLock()
+	defer dbp.RUnlock()
+
+	return dbp.repo[uid]
+}
+
+// prototype/db.go
+
+// TODO: use some normal DB
+
+// TODO: add versioned schema migrations (applied at startup, tracked in a version table) once notes live in SQL
+
+// NewDB creates a new prototype DB.
+func NewDB() DB {
+	return &db{}
+}
+
+// db is a prototype db.
+type db struct {
+	sync.RWMutex
+	repo   []Entry
+	lastID NoteID
+}
+
+// db implements the DB interface.
+var _ DB = (*db)(nil)
+
+// CreateNote adds a note to a prototype DB.
+func (db *db) CreateNote(ctx context.Context, e Entry) (Entry, error) {
+	if err := ctx.Err(); err != nil {
+		return Entry{}, err
+	}
+
+	db.Lock()
+	defer db.Unlock()
+
+	db.lastID++
+	e.ID = db.lastID
+	if e.Created.IsZero() {
+		e.Created = time.Now()
+	}
+
+	db.repo = append(db.repo, e)
+
+	return e, nil
+}
+
+// GetNote returns the note with the given ID from a prototype DB.
+func (db *db) GetNote(ctx context.Context, id NoteID) (Entry, error) {
+	if err := ctx.Err(); err != nil {
+		return Entry{}, err
+	}
+
+	db.RLock()
+	defer db.RUnlock()
+
+	for _, e := range db.repo {
+		if e.ID == id {
+			return e, nil
+		}
+	}
+
+	return Entry{}, ErrNoteNotFound
+}
+
+// DeleteNote removes the note with the given ID from a prototype DB.
+func (db *db) DeleteNote(ctx context.Context, id NoteID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	db.Lock()
+	defer db.Unlock()
+
+	for i, e := range db.repo {
+		if e.ID == id {
+			db.repo = append(db.repo[:i], db.repo[i+1:]...)
+			return nil
+		}
+	}
+
+	return ErrNoteNotFound
+}
+
+// DeleteExpiredNotes removes the notes expired by now from a prototype DB.
+func (db *db) DeleteExpiredNotes(ctx context.Context, now time.Time) ([]Entry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	db.Lock()
+	defer db.Unlock()
+
+	kept := []Entry{}
+	result := []Entry{}
+	for _, e := range db.repo {
+		if e.Expires.IsZero() || now.Before(e.Expires) {
+			kept = append(kept, e)
+		} else {
+			result = append(result, e)
+		}
+	}
+
+	db.repo = kept
+
+	return result, nil
+}
+
+// UpdateNote replaces the note with the same ID in a prototype DB.
+func (db *db) UpdateNote(ctx context.Context, e Entry) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	db.Lock()
+	defer db.Unlock()
+
+	for i := range db.repo {
+		if db.repo[i].ID == e.ID {
+			db.repo[i] = e
+			return nil
+		}
+	}
+
+	return ErrNoteNotFound
+}
+
+// ListNotes returns seleted notes for a prototype DB.
+func (db *db) ListNotes(ctx context.Context, f Filter) ([]Entry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	db.RLock()
+	defer db.RUnlock()
+
+	result := []Entry{}
+	for _, e := range db.repo {
+		if f.Match(e) {
+			result = append(result, e)
+		}
+	}
+
+	return result, nil
+}
+
+// CountNotes returns the number of seleted notes for a prototype DB.
+func (db *db) CountNotes(ctx context.Context, f Filter) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	db.RLock()
+	defer db.RUnlock()
+
+	result := 0
+	for _, e := range db.repo {
+		if f.Match(e) {
+			result++
+		}
+	}
+
+	return result, nil
+}
+
+// query/filter.go
+
+// TODO: match phrases through an optional full-text index (bleve) kept alongside the primary store, with rebuild and consistency-check commands
+
+// Match checks whether the entry satisfies the filter.
+func (f Filter) Match(e Entry) bool {
+	for _, tag := range f.Tags {
+		if !hasTag(e, tag) {
+			return false
+		}
+	}
+
+	for _, tag := range f.ExcludedTags {
+		if hasTag(e, tag) {
+			return false
+		}
+	}
+
+	txt := strings.ToLower(e.Text)
+	for _, p := range f.Phrases {
+		if !strings.Contains(txt, strings.ToLower(p)) {
+			return false
+		}
+	}
+
+	if !f.Before.IsZero() && !e.Created.Before(f.Before) {
+		return false
+	}
+
+	if !f.After.IsZero() && e.Created.Before(f.After) {
+		return false
+	}
+
+	if len(f.Priorities) != 0 && !hasPriority(f.Priorities, e.Priority) {
+		return false
+	}
+
+	return true
+}
+
+// hasPriority checks whether the priority is among the given ones.
+func hasPriority(ps []Priority, p Priority) bool {
+	for _, q := range ps {
+		if q == p {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Narrow returns the filter matching the entries satisfying both filters.
+func (f Filter) Narrow(other Filter) Filter {
+	result := Filter{
+		Tags:         append(append([]string{}, f.Tags...), other.Tags...),
+		ExcludedTags: append(append([]string{}, f.ExcludedTags...), other.ExcludedTags...),
+		Phrases:      append(append([]string{}, f.Phrases...), other.Phrases...),
+		Before:       f.Before,
+		After:        f.After,
+		Priorities:   f.Priorities,
+	}
+
+	if len(other.Priorities) != 0 {
+		result.Priorities = other.Priorities
+	}
+
+	if !other.Before.IsZero() && (result.Before.IsZero() || other.Before.Before(result.Before)) {
+		result.Before = other.Before
+	}
+
+	if other.After.After(result.After) {
+		result.After = other.After
+	}
+
+	return result
+}
+
+// hasTag checks whether the entry is tagged with the given tag.
+func hasTag(e Entry, tag string) bool {
+	for _, t := range e.Tags {
+		if t == tag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// query/query.go
+
+// dateLayout is the layout of dates in queries.
+// The dates are in the local time of the bot, like the days of /today and /onthisday.
+const dateLayout = "2006-01-02"
+
+// ParseQuery parses a query like `tag:work -tag:archived "quarterly report" before:2024-06-01` into a filter.
+// Quoted phrases and bare words are searched in the note text; dates are in the local time.
+func ParseQuery(q string) (Filter, error) {
+	terms, err := splitQuery(q)
+	if err != nil {
+		return Filter{}, err
+	}
+
+	var f Filter
+	for _, t := range terms {
+		if t.quoted {
+			f.Phrases = append(f.Phrases, t.text)
+			continue
+		}
+
+		key, value, ok := strings.Cut(t.text, ":")
+		if !ok || value == "" {
+			f.Phrases = append(f.Phrases, t.text)
+			continue
+		}
+
+		switch key {
+		case "tag":
+			f.Tags = append(f.Tags, value)
+		case "-tag":
+			f.ExcludedTags = append(f.ExcludedTags, value)
+		case "priority":
+			p, ok := ParsePriority(value)
+			if !ok {
+				return Filter{}, fmt.Errorf("%q is not a priority like low, normal or high", value)
+			}
+
+			f.Priorities = append(f.Priorities, p)
+		case "before", "after":
+			d, err := time.ParseInLocation(dateLayout, value, time.Local)
+			if err != nil {
+				return Filter{}, fmt.Errorf("%q is not a date like %s", value, dateLayout)
+			}
+
+			if key == "before" {
+				f.Before = d
+			} else {
+				f.After = d
+			}
+		default:
+			f.Phrases = append(f.Phrases, t.text)
+		}
+	}
+
+	return f, nil
+}
+
+// term is a single term of a query.
+type term struct {
+	text   string
+	quoted bool
+}
+
+// splitQuery splits the query into space-separated terms and quoted phrases.
+func splitQuery(q string) ([]term, error) {
+	result := []term{}
+	for {
+		q = strings.TrimSpace(q)
+		if q == "" {
+			return result, nil
+		}
+
+		if strings.HasPrefix(q, `"`) {
+			end := strings.Index(q[1:], `"`)
+			if end == -1 {
+				return nil, errors.New("the quote is not closed")
+			}
+
+			result = append(result, term{text: q[1 : end+1], quoted: true})
+			q = q[end+2:]
+
+			continue
+		}
+
+		end := strings.IndexAny(q, " \t\n")
+		if end == -1 {
+			end = len(q)
+		}
+
+		result = append(result, term{text: q[:end]})
+		q = q[end:]
+	}
+}
+
+// query/refine.go
+
+// ParseRefinement parses a follow-up like `only #work before June` narrowing a previous result.
+// It understands only, without (not, except), before, after, since and containing clauses;
+// months without a year refer to the current one and dates are in the local time.
+func ParseRefinement(txt string, now time.Time) (Filter, bool) {
+	words := strings.Fields(strings.ToLower(txt))
+	if len(words) == 0 {
+		return Filter{}, false
+	}
+
+	var f Filter
+	clause := ""
+	for i := 0; i < len(words); i++ {
+		w := words[i]
+		switch w {
+		case "only", "without", "not", "except", "before", "after", "since":
+			clause = w
+			continue
+		case "containing":
+			if i+1 == len(words) {
+				return Filter{}, false
+			}
+
+			f.Phrases = append(f.Phrases, strings.Join(words[i+1:], " "))
+			return f, true
+		}
+
+		switch clause {
+		case "only":
+			if w != "tagged" {
+				f.Tags = append(f.Tags, strings.TrimPrefix(w, "#"))
+			}
+		case "without", "not", "except":
+			if w != "tagged" {
+				f.ExcludedTags = append(f.ExcludedTags, strings.TrimPrefix(w, "#"))
+			}
+		case "before", "after", "since":
+			start, end, n, ok := parsePeriod(words[i:], now.Year())
+			if !ok {
+				return Filter{}, false
+			}
+
+			i += n - 1
+
+			switch clause {
+			case "before":
+				f.Before = start
+			case "after":
+				f.After = end
+			case "since":
+				f.After = start
+			}
+
+			clause = ""
+		default:
+			return Filter{}, false
+		}
+	}
+
+	return f, true
+}
+
+// parsePeriod parses a date, a year or a month (of the given year unless it's followed by one)
+// at the beginning of the words into its bounds and tells how many words it took.
+func parsePeriod(words []string, year int) (time.Time, time.Time, int, bool) {
+	if d, err := time.ParseInLocation(dateLayout, words[0], time.Local); err == nil {
+		return d, d.AddDate(0, 0, 1), 1, true
+	}
+
+	if y, ok := parseYear(words[0]); ok {
+		start := time.Date(y, time.January, 1, 0, 0, 0, 0, time.Local)
+		return start, start.AddDate(1, 0, 0), 1, true
+	}
+
+	for m := time.January; m <= time.December; m++ {
+		name := strings.ToLower(m.String())
+		if words[0] != name && (len(words[0]) < 3 || !strings.HasPrefix(name, words[0])) {
+			continue
+		}
+
+		n := 1
+		if len(words) > 1 {
+			if y, ok := parseYear(words[1]); ok {
+				year = y
+				n = 2
+			}
+		}
+
+		start := time.Date(year, m, 1, 0, 0, 0, 0, time.Local)
+		return start, start.AddDate(0, 1, 0), n, true
+	}
+
+	return time.Time{}, time.Time{}, 0, false
+}
+
+// parseYear parses a four-digit year.
+func parseYear(s string) (int, bool) {
+	y, err := strconv.Atoi(s)
+
+	return y, err == nil && len(s) == 4
+}
+
+// cache/db_provider.go
+
+// NewCachedDBProvider wraps the provider so that every user DB is served through a read-through cache.
+// It's meant for the backends slow to read (git) that nothing but the bot writes to,
+// so the memory backend and the fs one (edited on disk) are not cached.
+func NewCachedDBProvider(dbp DBProvider) DBProvider {
+	return &cachedDBProvider{
+		dbp:  dbp,
+		repo: map[UserID]DB{},
+	}
+}
+
+type cachedDBProvider struct {
+	sync.RWMutex
+	dbp  DBProvider
+	repo map[UserID]DB
+}
+
+// cachedDBProvider implements the DBProvider interface.
+var _ DBProvider = (*cachedDBProvider)(nil)
+
+// ProvideDB returns a cached DB for a given user.
+func (cdbp *cachedDBProvider) ProvideDB(uid UserID) DB {
+	if db := cdbp.getDB(uid); db != nil {
+		return db
+	}
+
+	cdbp.Lock()
+	defer cdbp.Unlock()
+
+	if db := cdbp.repo[uid]; db != nil {
+		return db
+	}
+
+	db := NewCachedDB(cdbp.dbp.ProvideDB(uid))
+
+	cdbp.repo[uid] = db
+
+	return db
+}
+
+// ListUsers returns the users of the underlying provider.
+func (cdbp *cachedDBProvider) ListUsers() []UserID {
+	return cdbp.dbp.ListUsers()
+}
+
+// getDB safely returns a cached DB from the provider.
+func (cdbp *cachedDBProvider) getDB(uid UserID) DB {
+	cdbp.RLock()
+	defer cdbp.RUnlock()
+
+	return cdbp.repo[uid]
+}
+
+// cache/db.go
+
+// NewCachedDB creates a read-through cache in front of the given DB.
+func NewCachedDB(db DB) DB {
+	return &cachedDB{
+		db:      db,
+		results: list.New(),
+		index:   map[string]*list.Element{},
+	}
+}
+
+// maxCachedResults is the number of listings and counts cached per user, the least recently used ones are dropped.
+const maxCachedResults = 64
+
+// cachedDB remembers listings and counts until the next write.
+type cachedDB struct {
+	sync.Mutex
+	db DB
+	// results are the cached results from the most recently used.
+	results *list.List
+	index   map[string]*list.Element
+}
+
+// cachedResult is a listing ([]Entry) or a count (int) cached under the key.
+type cachedResult struct {
+	key   string
+	value interface{}
+}
+
+// cachedDB implements the DB interface.
+var _ DB = (*cachedDB)(nil)
+
+// CreateNote adds a note to the underlying DB and invalidates the cache.
+func (c *cachedDB) CreateNote(ctx context.Context, e Entry) (Entry, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.invalidate()
+
+	return c.db.CreateNote(ctx, e)
+}
+
+// GetNote returns the note from the underlying DB.
+func (c *cachedDB) GetNote(ctx context.Context, id NoteID) (Entry, error) {
+	return c.db.GetNote(ctx, id)
+}
+
+// DeleteNote removes the note from the underlying DB and invalidates the cache.
+func (c *cachedDB) DeleteNote(ctx context.Context, id NoteID) error {
+	c.Lock()
+	defer c.Unlock()
+
+	c.invalidate()
+
+	return c.db.DeleteNote(ctx, id)
+}
+
+// DeleteExpiredNotes removes the expired notes from the underlying DB and invalidates the cache.
+func (c *cachedDB) DeleteExpiredNotes(ctx context.Context, now time.Time) ([]Entry, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.invalidate()
+
+	return c.db.DeleteExpiredNotes(ctx, now)
+}
+
+// UpdateNote replaces the note in the underlying DB and invalidates the cache.
+func (c *cachedDB) UpdateNote(ctx context.Context, e Entry) error {
+	c.Lock()
+	defer c.Unlock()
+
+	c.invalidate()
+
+	return c.db.UpdateNote(ctx, e)
+}
+
+// ListNotes returns the cached listing (a copy, so that it may be sorted) or reads it through from the underlying DB.
+func (c *cachedDB) ListNotes(ctx context.Context, f Filter) ([]Entry, error) {
+	key := "list|" + cacheKey(f)
+
+	c.Lock()
+	defer c.Unlock()
+
+	if result, ok := c.get(key); ok {
+		return append([]Entry{}, result.([]Entry)...), nil
+	}
+
+	result, err := c.db.ListNotes(ctx, f)
+	if err != nil {
+		return nil, err
+	}
+
+	c.put(key, result)
+
+	return append([]Entry{}, result...), nil
+}
+
+// CountNotes returns the cached count or reads it through from the underlying DB.
+func (c *cachedDB) CountNotes(ctx context.Context, f Filter) (int, error) {
+	key := "count|" + cacheKey(f)
+
+	c.Lock()
+	defer c.Unlock()
+
+	if result, ok := c.get(key); ok {
+		return result.(int), nil
+	}
+
+	result, err := c.db.CountNotes(ctx, f)
+	if err != nil {
+		return 0, err
+	}
+
+	c.put(key, result)
+
+	return result, nil
+}
+
+// get returns the cached result and marks it as the most recently used.
+func (c *cachedDB) get(key string) (interface{}, bool) {
+	el, ok := c.index[key]
+	if !ok {
+		return nil, false
+	}
+
+	c.results.MoveToFront(el)
+
+	return el.Value.(cachedResult).value, true
+}
+
+// put caches the result, dropping the least recently used one if the cache is full.
+func (c *cachedDB) put(key string, value interface{}) {
+	c.index[key] = c.results.PushFront(cachedResult{key: key, value: value})
+	if c.results.Len() > maxCachedResults {
+		oldest := c.results.Back()
+		c.results.Remove(oldest)
+		delete(c.index, oldest.Value.(cachedResult).key)
+	}
+}
+
+// invalidate drops everything cached.
+func (c *cachedDB) invalidate() {
+	c.results.Init()
+	c.index = map[string]*list.Element{}
+}
+
+// cacheKey makes the same key for the same filter regardless of the order of its terms.
+func cacheKey(f Filter) string {
+	priorities := []string{}
+	for _, p := range f.Priorities {
+		priorities = append(priorities, p.String())
+	}
+
+	return fmt.Sprintf("%s|%s|%s|%d|%d|%s",
+		sortedKey(f.Tags),
+		sortedKey(f.ExcludedTags),
+		sortedKey(f.Phrases),
+		f.Before.UnixNano(),
+		f.After.UnixNano(),
+		sortedKey(priorities),
+	)
+}
+
+// sortedKey joins the strings regardless of their order.
+func sortedKey(ss []string) string {
+	sorted := append([]string{}, ss...)
+	sort.Strings(sorted)
+
+	return strings.Join(sorted, ",")
+}
+
+// sweeper/sweeper.go
+
+// TODO: auto-archive the notes untouched for N days (opt-in, sparing the pinned ones) with a weekly summary once the archive, pins and last-touched times exist
+
+// Sweep deletes the expired notes of all the users every interval until the context is done.
+func Sweep(ctx context.Context, dbp DBProvider, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			for _, uid := range dbp.ListUsers() {
+				deleted, err := dbp.ProvideDB(uid).DeleteExpiredNotes(ctx, now)
+				if err != nil {
+					log.Printf("Failed to delete the expired notes of user %d: %v", uid, err)
+					continue
+				}
+
+				if len(deleted) != 0 {
+					log.Printf("Deleted %d expired notes of user %d", len(deleted), uid)
+				}
+			}
+		}
+	}
+}
+
+// http/handler.go
+
+// NewHTTPHandler serves the read-only views and the feeds of the shared notes.
+func NewHTTPHandler(dbp DBProvider, shares ShareRepository) http.Handler {
+	h := &httpHandler{
+		dbp:    dbp,
+		shares: shares,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/shared/", h.serveShared)
+	mux.HandleFunc("/feed/", h.serveFeed)
+	// TODO: authenticate the REST API (once there is one) with bearer tokens minted by /apitoken create|revoke and hashed at rest
+	// TODO: serve a tokenized .ics feed of the pending and recurring reminders once reminders exist
+
+	return mux
+}
+
+type httpHandler struct {
+	dbp    DBProvider
+	shares ShareRepository
+}
+
+// jsonNote is a note as served in JSON.
+type jsonNote struct {
+	ID      NoteID    `json:"id"`
+	Text    string    `json:"text"`
+	Tags    []string  `json:"tags"`
+	Created time.Time `json:"created"`
+}
+
+// newJSONNote prepares the note for serving in JSON.
+func newJSONNote(e Entry) jsonNote {
+	return jsonNote{
+		ID:      e.ID,
+		Text:    e.Text,
+		Tags:    e.Tags,
+		Created: e.Created,
+	}
+}
+
+// sharedTemplate renders the shared notes in HTML.
+var sharedTemplate = template.Must(template.New("shared").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Notes{{with .Tag}} tagged {{.}}{{end}}</title></head>
+<body>
+<h1>Notes{{with .Tag}} tagged {{.}}{{end}}</h1>
+{{range .Notes}}<article>
+<p><small>#{{.ID}} {{.Created.Format "2006-01-02"}}{{range .Tags}} [{{.}}]{{end}}</small></p>
+<p style="white-space: pre-wrap">{{.Text}}</p>
+</article>
+{{else}}<p>No notes yet.</p>
+{{end}}</body>
+</html>
+`))
+
+// serveShared serves the notes shared by the token in HTML or, with ?format=json, in JSON.
+func (h *httpHandler) serveShared(w http.ResponseWriter, r *http.Request) {
+	s, entries, ok := h.listShared(w, r, strings.TrimPrefix(r.URL.Path, "/shared/"))
+	if !ok {
+		return
+	}
+
+	notes := []jsonNote{}
+	for _, e := range entries {
+		notes = append(notes, newJSONNote(e))
+	}
+
+	if r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(notes)
+		return
+	}
+
+	sharedTemplate.Execute(w, struct {
+		Tag   string
+		Notes []jsonNote
+	}{
+		Tag:   s.Tag,
+		Notes: notes,
+	})
+}
+
+// listShared lists the notes shared by the token or replies with an error.
+func (h *httpHandler) listShared(w http.ResponseWriter, r *http.Request, token string) (Share, []Entry, bool) {
+	s, ok := h.shares.ProvideShare(token)
+	if !ok {
+		http.NotFound(w, r)
+		return Share{}, nil, false
+	}
+
+	f := Filter{}
+	if s.Tag != "" {
+		f.Tags = []string{s.Tag}
+	}
+
+	entries, err := h.dbp.ProvideDB(s.UserID).ListNotes(r.Context(), f)
+	if err != nil {
+		log.Printf("Failed to list the notes shared by user %d: %v", s.UserID, err)
+		http.Error(w, "Something went wrong! Please, try again later.", http.StatusInternalServerError)
+		return Share{}, nil, false
+	}
+
+	return s, entries, true
+}
+
+// feedLength is the number of the most recent notes served in a feed.
+const feedLength = 50
+
+// atomFeed is an Atom feed of notes.
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated time.Time   `xml:"updated"`
+	Author  string      `xml:"author>name"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+// atomEntry is a note in an Atom feed.
+type atomEntry struct {
+	ID         string         `xml:"id"`
+	Title      string         `xml:"title"`
+	Updated    time.Time      `xml:"updated"`
+	Categories []atomCategory `xml:"category"`
+	Content    string         `xml:"content"`
+}
+
+// atomCategory is a tag of a note in an Atom feed.
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+// serveFeed serves the most recent notes shared by the token as an Atom feed.
+func (h *httpHandler) serveFeed(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, "/feed/")
+	s, entries, ok := h.listShared(w, r, token)
+	if !ok {
+		return
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Created.After(entries[j].Created)
+	})
+
+	if len(entries) > feedLength {
+		entries = entries[:feedLength]
+	}
+
+	feed := atomFeed{
+		ID:      "urn:notes:feed:" + token,
+		Title:   "Notes",
+		Updated: time.Now(),
+		Author:  "NotesWithTagsTelegramBot",
+	}
+
+	if s.Tag != "" {
+		feed.Title = "Notes tagged " + s.Tag
+	}
+
+	if len(entries) != 0 {
+		feed.Updated = entries[0].Created
+	}
+
+	for _, e := range entries {
+		entry := atomEntry{
+			ID:      fmt.Sprintf("urn:notes:user:%d:note:%d", s.UserID, e.ID),
+			Title:   preview(e),
+			Updated: e.Created,
+			Content: e.Text,
+		}
+
+		for _, t := range e.Tags {
+			entry.Categories = append(entry.Categories, atomCategory{Term: t})
+		}
+
+		feed.Entries = append(feed.Entries, entry)
+	}
+
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(feed)
+}
+
+// telegram/messenger.go
+
+// NewTelegramMessenger creates a messenger sending messages through the outbox of the bot.
+func NewTelegramMessenger(outbox Outbox) Messenger {
+	return telegramMessenger{
+		outbox: outbox,
+	}
+}
+
+type telegramMessenger struct {
+	outbox Outbox
+}
+
+// telegramMessenger implements the Messenger interface.
+var _ Messenger = telegramMessenger{}
+
+// SendMessage queues the message to the private chat with the user.
+func (tm telegramMessenger) SendMessage(ctx context.Context, uid UserID, txt string) error {
+	return tm.outbox.Enqueue(OutgoingMessage{
+		ChatID: int64(uid),
+		Text:   txt,
+	})
+}
+
+// telegram/channels.go
+
+// NewTelegramChannelAdmins creates the function asking Telegram for the admins of a channel.
+func NewTelegramChannelAdmins(bot *tgbotapi.BotAPI) func(ctx context.Context, channel UserID) ([]UserID, error) {
+	return func(ctx context.Context, channel UserID) ([]UserID, error) {
+		members, err := bot.GetChatAdministrators(tgbotapi.ChatConfig{ChatID: int64(channel)})
+		if err != nil {
+			return nil, err
+		}
+
+		result := []UserID{}
+		for _, m := range members {
+			if m.User != nil {
+				result = append(result, UserID(m.User.ID))
+			}
+		}
+
+		return result, nil
+	}
+}
+
+// telegram/sender.go
+
+// NewTelegramSender creates the function sending the messages of an outbox through the bot.
+func NewTelegramSender(bot *tgbotapi.BotAPI) func(OutgoingMessage) error {
+	return func(m OutgoingMessage) error {
+		r := tgbotapi.NewMessage(m.ChatID, m.Text)
+		switch m.Keyboard {
+		case KeyboardShown:
+			r.ReplyMarkup = replyKeyboard()
+		case KeyboardHidden:
+			r.ReplyMarkup = tgbotapi.NewRemoveKeyboard(false)
+		}
+
+		_, err := bot.Send(r)
+
+		// Telegram refuses the message for good on the client errors other than flood control.
+		var apiErr tgbotapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code >= 400 && apiErr.Code < 500 && apiErr.Code != http.StatusTooManyRequests {
+			return fmt.Errorf("%w: %v", ErrUndeliverable, err)
+		}
+
+		return err
+	}
+}
+
+// replyKeyboard builds the reply keyboard with the common commands.
+func replyKeyboard() tgbotapi.ReplyKeyboardMarkup {
+	rows := [][]tgbotapi.KeyboardButton{}
+	for _, labels := range GetKeyboard() {
+		row := []tgbotapi.KeyboardButton{}
+		for _, l := range labels {
+			row = append(row, tgbotapi.NewKeyboardButton(l))
+		}
+
+		rows = append(rows, tgbotapi.NewKeyboardButtonRow(row...))
+	}
+
+	return tgbotapi.NewReplyKeyboard(rows...)
+}
+
+// channel/archiver.go
+
+// NewChannelArchiver creates an archiver storing the posts in the notebooks of the channels within the limits.
+// The admins of a channel are looked up with admins, nobody is an admin if it's nil.
+func NewChannelArchiver(db DBProvider, limits Limits, q Quotas, admins func(ctx context.Context, channel UserID) ([]UserID, error)) Archiver {
+	return &channelArchiver{
+		db:       db,
+		limits:   limits,
+		quotas:   q,
+		admins:   admins,
+		channels: map[string]UserID{},
+	}
+}
+
+type channelArchiver struct {
+	sync.RWMutex
+	db     DBProvider
+	limits Limits
+	quotas Quotas
+	admins func(ctx context.Context, channel UserID) ([]UserID, error)
+	// channels are the IDs of the channels by their lowercase usernames.
+	channels map[string]UserID
+}
+
+// channelArchiver implements the Archiver interface.
+var _ Archiver = (*channelArchiver)(nil)
+
+// ArchivePost stores the post as a note tagged with its hashtags, split or rejected if it's too long.
+func (ca *channelArchiver) ArchivePost(ctx context.Context, channel UserID, username string, text string) error {
+	if username != "" {
+		ca.Lock()
+		ca.channels[strings.ToLower(username)] = channel
+		ca.Unlock()
+	}
+
+	if strings.TrimSpace(text) == "" {
+		return nil
+	}
+
+	parts := []string{text}
+	if n := utf8.RuneCountInString(text); ca.limits.MaxNoteLength != 0 && n > ca.limits.MaxNoteLength {
+		if ca.limits.LongNotes != SplitLongNotes {
+			return fmt.Errorf("the post is too long (%d characters)", n)
+		}
+
+		parts = splitText(text, ca.limits.MaxNoteLength)
+	}
+
+	db := ca.db.ProvideDB(channel)
+	if max := ca.quotas.MaxNotes(channel); max != 0 {
+		n, err := db.CountNotes(ctx, Filter{})
+		if err != nil {
+			return err
+		}
+
+		if n+len(parts) > max {
+			return fmt.Errorf("channel %d has %d notes already", channel, n)
+		}
+	}
+
+	tags := hashtags(text)
+	for _, p := range parts {
+		if _, err := db.CreateNote(ctx, Entry{Text: p, Tags: tags}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ChannelDB resolves the channel and checks with Telegram that the user is its admin.
+func (ca *channelArchiver) ChannelDB(ctx context.Context, channel string, uid UserID) (DB, error) {
+	var id UserID
+	if n, err := strconv.ParseInt(channel, 10, 64); err == nil {
+		id = UserID(n)
+	} else {
+		ca.RLock()
+		found, ok := ca.channels[strings.ToLower(strings.TrimPrefix(channel, "@"))]
+		ca.RUnlock()
+
+		if !ok {
+			return nil, ErrUnknownChannel
+		}
+
+		id = found
+	}
+
+	if ca.admins == nil {
+		return nil, ErrNotChannelAdmin
+	}
+
+	admins, err := ca.admins(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isAdmin(admins, uid) {
+		return nil, ErrNotChannelAdmin
+	}
+
+	return ca.db.ProvideDB(id), nil
+}
+
+// hashtags returns the distinct #hashtags of the text without the hash sign.
+func hashtags(text string) []string {
+	words := strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '#' && r != '_'
+	})
+
+	result := []string{}
+	seen := map[string]bool{}
+	for _, w := range words {
+		tag := strings.TrimPrefix(w, "#")
+		if !strings.HasPrefix(w, "#") || tag == "" || strings.Contains(tag, "#") || seen[tag] {
+			continue
+		}
+
+		seen[tag] = true
+		result = append(result, tag)
+	}
+
+	return result
+}
+
+// telegraph/publisher.go
+
+// telegraphAPI is the base URL of the Telegraph API.
+const telegraphAPI = "https://api.telegra.ph"
+
+// NewTelegraphPublisher creates a publisher posting to telegra.ph on behalf of the account with the token.
+func NewTelegraphPublisher(token string) Publisher {
+	return telegraphPublisher{
+		token:  token,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type telegraphPublisher struct {
+	token  string
+	client *http.Client
+}
+
+// telegraphPublisher implements the Publisher interface.
+var _ Publisher = telegraphPublisher{}
+
+// telegraphNode is an element of the content of a Telegraph page.
+type telegraphNode struct {
+	Tag      string        `json:"tag"`
+	Children []interface{} `json:"children,omitempty"`
+}
+
+// telegraphResponse is a response of the Telegraph API.
+type telegraphResponse struct {
+	OK     bool   `json:"ok"`
+	Error  string `json:"error"`
+	Result struct {
+		Path string `json:"path"`
+		URL  string `json:"url"`
+	} `json:"result"`
+}
+
+// telegraphTitleLength is the maximum number of characters in the title of a page.
+const telegraphTitleLength = 256
+
+// Publish creates the page of the note or, if it's published already, updates it.
+func (tp telegraphPublisher) Publish(ctx context.Context, author string, e Entry) (string, string, error) {
+	title := strings.TrimSpace(strings.SplitN(e.Text, "\n", 2)[0])
+	if runes := []rune(title); len(runes) > telegraphTitleLength {
+		title = string(runes[:telegraphTitleLength-1]) + "…"
+	}
+
+	if title == "" {
+		title = fmt.Sprintf("Note #%d", e.ID)
+	}
+
+	content, err := json.Marshal(toTelegraphContent(e.Text))
+	if err != nil {
+		return "", "", err
+	}
+
+	method := "/createPage"
+	if e.PagePath != "" {
+		method = "/editPage/" + e.PagePath
+	}
+
+	form := url.Values{
+		"access_token": {tp.token},
+		"title":        {title},
+		"author_name":  {author},
+		"content":      {string(content)},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, telegraphAPI+method, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", "", err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := tp.client.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+
+	var r telegraphResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return "", "", err
+	}
+
+	if !r.OK {
+		return "", "", fmt.Errorf("telegraph: %s", r.Error)
+	}
+
+	return r.Result.Path, r.Result.URL, nil
+}
+
+// toTelegraphContent renders the text as paragraphs separated by the blank lines.
+func toTelegraphContent(txt string) []telegraphNode {
+	result := []telegraphNode{}
+	for _, p := range strings.Split(strings.ReplaceAll(txt, "\r\n", "\n"), "\n\n") {
+		if strings.TrimSpace(p) == "" {
+			continue
+		}
+
+		node := telegraphNode{Tag: "p"}
+		for i, line := range strings.Split(p, "\n") {
+			if i != 0 {
+				node.Children = append(node.Children, telegraphNode{Tag: "br"})
+			}
+
+			node.Children = append(node.Children, line)
+		}
+
+		result = append(result, node)
+	}
+
+	return result
+}
+
+// mail/smtp.go
+
+// NewSMTPMailer starts sending the queued emails through the SMTP server until the context is done.
+// The requesters are told through the messenger if their emails fail.
+func NewSMTPMailer(ctx context.Context, cfg SMTPConfig, m Messenger) Mailer {
+	sm := &smtpMailer{
+		cfg:   cfg,
+		m:     m,
+		queue: make(chan Mail, 100),
+	}
+
+	go sm.run(ctx)
+
+	return sm
+}
+
+type smtpMailer struct {
+	cfg   SMTPConfig
+	m     Messenger
+	queue chan Mail
+}
+
+// smtpMailer implements the Mailer interface.
+var _ Mailer = (*smtpMailer)(nil)
+
+// QueueMail queues the email for sending.
+func (sm *smtpMailer) QueueMail(ml Mail) error {
+	select {
+	case sm.queue <- ml:
+		return nil
+	default:
+		return ErrMailQueueFull
+	}
+}
+
+// run sends the queued emails one by one.
+func (sm *smtpMailer) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ml := <-sm.queue:
+			if err := sm.send(ml); err != nil {
+				log.Printf("Failed to email %s for user %d: %v", ml.To, ml.Requester, err)
+				sm.m.SendMessage(ctx, ml.Requester, fmt.Sprintf("Failed to email %s! Please, try again later.", ml.To))
+			}
+		}
+	}
+}
+
+// send sends a plain text email.
+func (sm *smtpMailer) send(ml Mail) error {
+	var auth smtp.Auth
+	if sm.cfg.Username != "" {
+		host, _, err := net.SplitHostPort(sm.cfg.Addr)
+		if err != nil {
+			return err
+		}
+
+		auth = smtp.PlainAuth("", sm.cfg.Username, sm.cfg.Password, host)
+	}
+
+	msg := strings.Join([]string{
+		"From: " + sm.cfg.From,
+		"To: " + ml.To,
+		"Subject: " + mime.QEncoding.Encode("utf-8", ml.Subject),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=utf-8",
+		"",
+		strings.ReplaceAll(ml.Body, "\n", "\r\n"),
+	}, "\r\n")
+
+	return smtp.SendMail(sm.cfg.Addr, auth, sm.cfg.From, []string{ml.To}, []byte(msg))
+}
+
+// webhook/db_provider.go
+
+// NewHookedDBProvider wraps the provider so that every write to a user DB emits an event.
+func NewHookedDBProvider(dbp DBProvider, hooks Webhooks) DBProvider {
+	return hookedDBProvider{
+		dbp:   dbp,
+		hooks: hooks,
+	}
+}
+
+type hookedDBProvider struct {
+	dbp   DBProvider
+	hooks Webhooks
+}
+
+// hookedDBProvider implements the DBProvider interface.
+var _ DBProvider = hookedDBProvider{}
+
+// ProvideDB returns a DB emitting the events of the given user.
+func (hdbp hookedDBProvider) ProvideDB(uid UserID) DB {
+	return hookedDB{
+		uid:   uid,
+		db:    hdbp.dbp.ProvideDB(uid),
+		hooks: hdbp.hooks,
+	}
+}
+
+// ListUsers returns the users of the underlying provider.
+func (hdbp hookedDBProvider) ListUsers() []UserID {
+	return hdbp.dbp.ListUsers()
+}
+
+// webhook/db.go
+
+// hookedDB emits an event on every successful write.
+type hookedDB struct {
+	uid   UserID
+	db    DB
+	hooks Webhooks
+}
+
+// hookedDB implements the DB interface.
+var _ DB = hookedDB{}
+
+// CreateNote adds a note to the underlying DB and emits the creation.
+func (h hookedDB) CreateNote(ctx context.Context, e Entry) (Entry, error) {
+	e, err := h.db.CreateNote(ctx, e)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	h.emit(NoteCreated, e)
+
+	return e, nil
+}
+
+// GetNote returns the note from the underlying DB.
+func (h hookedDB) GetNote(ctx context.Context, id NoteID) (Entry, error) {
+	return h.db.GetNote(ctx, id)
+}
+
+// ListNotes returns the notes from the underlying DB.
+func (h hookedDB) ListNotes(ctx context.Context, f Filter) ([]Entry, error) {
+	return h.db.ListNotes(ctx, f)
+}
+
+// CountNotes returns the number of notes from the underlying DB.
+func (h hookedDB) CountNotes(ctx context.Context, f Filter) (int, error) {
+	return h.db.CountNotes(ctx, f)
+}
+
+// DeleteNote removes the note from the underlying DB and emits the deletion.
+func (h hookedDB) DeleteNote(ctx context.Context, id NoteID) error {
+	e, err := h.db.GetNote(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if err := h.db.DeleteNote(ctx, id); err != nil {
+		return err
+	}
+
+	h.emit(NoteDeleted, e)
+
+	return nil
+}
+
+// UpdateNote replaces the note in the underlying DB and emits the update.
+func (h hookedDB) UpdateNote(ctx context.Context, e Entry) error {
+	if err := h.db.UpdateNote(ctx, e); err != nil {
+		return err
+	}
+
+	h.emit(NoteUpdated, e)
+
+	return nil
+}
+
+// DeleteExpiredNotes removes the expired notes from the underlying DB and emits the deletions.
+func (h hookedDB) DeleteExpiredNotes(ctx context.Context, now time.Time) ([]Entry, error) {
+	deleted, err := h.db.DeleteExpiredNotes(ctx, now)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range deleted {
+		h.emit(NoteDeleted, e)
+	}
+
+	return deleted, nil
+}
+
+// emit emits the event of the user.
+func (h hookedDB) emit(t EventType, e Entry) {
+	h.hooks.Emit(h.uid, Event{
+		Type: t,
+		Note: e,
+		Time: time.Now(),
+	})
+}
+
+// webhook/webhooks.go
+
+// TODO: add a Notion sync (/connectnotion, notes as pages, tags as multi-select) as an Emit consumer once per-user integration tokens can be stored
+// TODO: sync todo notes to Todoist tasks (closing them on /done) once todos, /done and encrypted per-user preferences exist
+
+// NewWebhooks starts delivering the emitted events until the context is done.
+func NewWebhooks(ctx context.Context) Webhooks {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: dialPublicOnly,
+	}
+
+	w := &webhooks{
+		repo:  map[UserID]webhook{},
+		queue: make(chan delivery, 1000),
+		client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{DialContext: dialer.DialContext},
+		},
+	}
+
+	go w.run(ctx)
+
+	return w
+}
+
+type webhooks struct {
+	sync.RWMutex
+	repo   map[UserID]webhook
+	queue  chan delivery
+	client *http.Client
+}
+
+// webhooks implements the Webhooks interface.
+var _ Webhooks = (*webhooks)(nil)
+
+// webhook is a URL configured by a user.
+type webhook struct {
+	url    string
+	secret string
+}
+
+// delivery is a payload waiting to be posted.
+type delivery struct {
+	webhook webhook
+	body    []byte
+}
+
+// webhookPayload is an event as posted to a webhook.
+type webhookPayload struct {
+	Type   EventType `json:"type"`
+	Time   time.Time `json:"time"`
+	UserID UserID    `json:"user_id"`
+	Note   jsonNote  `json:"note"`
+}
+
+// webhookAttempts is how many times a payload is posted before it's dropped.
+const webhookAttempts = 3
+
+// ErrNonPublicAddress is returned when a webhook resolves to an address of the host or its network.
+var ErrNonPublicAddress = errors.New("address is not public")
+
+// dialPublicOnly refuses to connect to the addresses that aren't public, so that users can't make the bot
+// post to itself or to its network. It checks the resolved address, which covers the redirects and DNS tricks.
+func dialPublicOnly(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !isPublicIP(ip) {
+		return fmt.Errorf("%s: %w", host, ErrNonPublicAddress)
+	}
+
+	return nil
+}
+
+// sharedAddressSpace is the carrier-grade NAT range, which is not covered by net.IP.IsPrivate.
+var sharedAddressSpace = &net.IPNet{IP: net.IP{100, 64, 0, 0}, Mask: net.CIDRMask(10, 32)}
+
+// isPublicIP tells whether the IP is reachable on the internet.
+func isPublicIP(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !sharedAddressSpace.Contains(ip)
+}
+
+// SetWebhook configures the URL of the user with a new secret.
+func (w *webhooks) SetWebhook(uid UserID, url string) (string, error) {
+	secret, err := newToken()
+	if err != nil {
+		return "", err
+	}
+
+	w.Lock()
+	defer w.Unlock()
+
+	w.repo[uid] = webhook{
+		url:    url,
+		secret: secret,
+	}
+
+	return secret, nil
+}
+
+// DeleteWebhook removes the URL of the user.
+func (w *webhooks) DeleteWebhook(uid UserID) bool {
+	w.Lock()
+	defer w.Unlock()
+
+	_, ok := w.repo[uid]
+	delete(w.repo, uid)
+
+	return ok
+}
+
+// Emit queues the event for the webhook of the user if there is one.
+func (w *webhooks) Emit(uid UserID, e Event) {
+	w.RLock()
+	hook, ok := w.repo[uid]
+	w.RUnlock()
+
+	if !ok {
+		return
+	}
+
+	body, err := json.Marshal(webhookPayload{
+		Type:   e.Type,
+		Time:   e.Time,
+		UserID: uid,
+		Note:   newJSONNote(e.Note),
+	})
+	if err != nil {
+		log.Printf("Failed to encode the %s event of user %d: %v", e.Type, uid, err)
+		return
+	}
+
+	select {
+	case w.queue <- delivery{webhook: hook, body: body}:
+	default:
+		log.Printf("Dropped the %s event of user %d: the queue is full", e.Type, uid)
+	}
+}
+
+// run posts the queued payloads one by one.
+func (w *webhooks) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case d := <-w.queue:
+			for attempt := 1; ; attempt++ {
+				err := w.post(ctx, d)
+				if err == nil {
+					break
+				}
+
+				if attempt == webhookAttempts {
+					log.Printf("Failed to post to %s: %v", d.webhook.url, err)
+					break
+				}
+
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(time.Duration(attempt) * time.Second):
+				}
+			}
+		}
+	}
+}
+
+// post posts the signed payload.
+func (w *webhooks) post(ctx context.Context, d delivery) error {
+	mac := hmac.New(sha256.New, []byte(d.webhook.secret))
+	mac.Write(d.body)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.webhook.url, bytes.NewReader(d.body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
+
+// files/db.go
+
+// NewFilesDB creates a DB keeping every note as a Markdown file in the directory
+// along with an index of the notes, which is rewritten on every change.
+// The changes are reported to onChange (if set) once they are on disk.
+func NewFilesDB(dir string, onChange func(msg string) error) DB {
+	return &filesDB{
+		dir:      dir,
+		onChange: onChange,
+	}
+}
+
+// filesDB reads the directory on every query, so the notes may be edited on disk directly.
+type filesDB struct {
+	sync.RWMutex
+	dir      string
+	lastID   NoteID
+	onChange func(msg string) error
+}
+
+// filesDB implements the DB interface.
+var _ DB = (*filesDB)(nil)
+
+// noteExt is the extension of the note files.
+const noteExt = ".md"
+
+// indexFile lists the notes and keeps the last ID, so that the IDs of the deleted notes aren't reused.
+const indexFile = "index" + noteExt
+
+// CreateNote writes the note to a new file.
+func (db *filesDB) CreateNote(ctx context.Context, e Entry) (Entry, error) {
+	if err := ctx.Err(); err != nil {
+		return Entry{}, err
+	}
+
+	db.Lock()
+	defer db.Unlock()
+
+	if db.lastID == 0 {
+		var err error
+		if db.lastID, err = db.readLastID(); err != nil {
+			return Entry{}, err
+		}
+
+		files, err := os.ReadDir(db.dir)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return Entry{}, err
+		}
+
+		for _, f := range files {
+			if id, err := strconv.Atoi(strings.TrimSuffix(f.Name(), noteExt)); err == nil && NoteID(id) > db.lastID {
+				db.lastID = NoteID(id)
+			}
+		}
+	}
+
+	// Going past the files added by hand since (even the broken ones), so that none is overwritten.
+	for {
+		db.lastID++
+		if _, err := os.Stat(db.path(db.lastID)); errors.Is(err, os.ErrNotExist) {
+			break
+		} else if err != nil {
+			return Entry{}, err
+		}
+	}
+
+	e.ID = db.lastID
+	if e.Created.IsZero() {
+		e.Created = time.Now()
+	}
+
+	if err := os.MkdirAll(db.dir, 0o755); err != nil {
+		return Entry{}, err
+	}
+
+	if err := os.WriteFile(db.path(e.ID), formatNote(e), 0o644); err != nil {
+		return Entry{}, err
+	}
+
+	if err := db.writeIndex(); err != nil {
+		return Entry{}, err
+	}
+
+	return e, db.changed(fmt.Sprintf("Create note #%d", e.ID))
+}
+
+// GetNote reads the file of the note.
+func (db *filesDB) GetNote(ctx context.Context, id NoteID) (Entry, error) {
+	if err := ctx.Err(); err != nil {
+		return Entry{}, err
+	}
+
+	db.RLock()
+	defer db.RUnlock()
+
+	return db.readNote(db.path(id))
+}
+
+// DeleteNote removes the file of the note.
+func (db *filesDB) DeleteNote(ctx context.Context, id NoteID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	db.Lock()
+	defer db.Unlock()
+
+	if err := os.Remove(db.path(id)); errors.Is(err, os.ErrNotExist) {
+		return ErrNoteNotFound
+	} else if err != nil {
+		return err
+	}
+
+	if err := db.writeIndex(); err != nil {
+		return err
+	}
+
+	return db.changed(fmt.Sprintf("Delete note #%d", id))
+}
+
+// DeleteExpiredNotes removes the files of the notes expired by now.
+func (db *filesDB) DeleteExpiredNotes(ctx context.Context, now time.Time) ([]Entry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	db.Lock()
+	defer db.Unlock()
+
+	entries, err := db.readNotes()
+	if err != nil {
+		return nil, err
+	}
+
+	result := []Entry{}
+	for _, e := range entries {
+		if e.Expires.IsZero() || now.Before(e.Expires) {
+			continue
+		}
+
+		if err := os.Remove(db.path(e.ID)); err != nil {
+			return result, err
+		}
+
+		result = append(result, e)
+	}
+
+	if len(result) == 0 {
+		return result, nil
+	}
+
+	if err := db.writeIndex(); err != nil {
+		return result, err
+	}
+
+	return result, db.changed(fmt.Sprintf("Delete %d expired notes", len(result)))
+}
+
+// UpdateNote rewrites the file of the note.
+func (db *filesDB) UpdateNote(ctx context.Context, e Entry) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	db.Lock()
+	defer db.Unlock()
+
+	if _, err := os.Stat(db.path(e.ID)); errors.Is(err, os.ErrNotExist) {
+		return ErrNoteNotFound
+	} else if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(db.path(e.ID), formatNote(e), 0o644); err != nil {
+		return err
+	}
+
+	if err := db.writeIndex(); err != nil {
+		return err
+	}
+
+	return db.changed(fmt.Sprintf("Update note #%d", e.ID))
+}
+
+// ListNotes reads the files of the selected notes.
+func (db *filesDB) ListNotes(ctx context.Context, f Filter) ([]Entry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	db.RLock()
+	defer db.RUnlock()
+
+	entries, err := db.readNotes()
+	if err != nil {
+		return nil, err
+	}
+
+	result := []Entry{}
+	for _, e := range entries {
+		if f.Match(e) {
+			result = append(result, e)
+		}
+	}
+
+	return result, nil
+}
+
+// CountNotes returns the number of the selected notes.
+func (db *filesDB) CountNotes(ctx context.Context, f Filter) (int, error) {
+	entries, err := db.ListNotes(ctx, f)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(entries), nil
+}
+
+// path returns the file of the note.
+func (db *filesDB) path(id NoteID) string {
+	return filepath.Join(db.dir, strconv.Itoa(int(id))+noteExt)
+}
+
+// changed reports the change.
+func (db *filesDB) changed(msg string) error {
+	if db.onChange == nil {
+		return nil
+	}
+
+	return db.onChange(msg)
+}
+
+// writeIndex lists the notes in the index file.
+func (db *filesDB) writeIndex() error {
+	entries, err := db.readNotes()
+	if err != nil {
+		return err
+	}
+
+	var b strings.Builder
+
+	fmt.Fprintln(&b, frontMatterDelimiter)
+	fmt.Fprintf(&b, "last_id: %d\n", db.lastID)
+	fmt.Fprintln(&b, frontMatterDelimiter)
+	for _, e := range entries {
+		fmt.Fprintf(&b, "- [%s](%d%s)\n", preview(e), e.ID, noteExt)
+	}
+
+	return os.WriteFile(filepath.Join(db.dir, indexFile), []byte(b.String()), 0o644)
+}
+
+// readLastID reads the last ID from the index file, 0 if there is none.
+func (db *filesDB) readLastID() (NoteID, error) {
+	b, err := os.ReadFile(filepath.Join(db.dir, indexFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	for _, line := range strings.Split(string(b), "\n") {
+		if value, ok := strings.CutPrefix(line, "last_id:"); ok {
+			id, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				return 0, fmt.Errorf("%s: bad last_id: %w", indexFile, err)
+			}
+
+			return NoteID(id), nil
+		}
+	}
+
+	return 0, nil
+}
+
+// readNotes reads all the notes in the directory ordered by ID.
+func (db *filesDB) readNotes() ([]Entry, error) {
+	files, err := os.ReadDir(db.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []Entry{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	result := []Entry{}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), noteExt) {
+			continue
+		}
+
+		if _, err := strconv.Atoi(strings.TrimSuffix(f.Name(), noteExt)); err != nil {
+			continue
+		}
+
+		// Skipping the files broken by hand, so that the other notes stay available.
+		e, err := db.readNote(filepath.Join(db.dir, f.Name()))
+		if err != nil {
+			log.Printf("Skipped a note: %v", err)
+			continue
+		}
+
+		result = append(result, e)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+
+	return result, nil
+}
+
+// readNote reads the note from the file.
+func (db *filesDB) readNote(path string) (Entry, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return Entry{}, ErrNoteNotFound
+	} else if err != nil {
+		return Entry{}, err
+	}
+
+	e, err := parseNote(string(b))
+	if err != nil {
+		return Entry{}, fmt.Errorf("%s: %w", path, err)
+	}
+
+	// Completing the notes written by hand without the front matter.
+	if e.ID == 0 {
+		id, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(path), noteExt))
+		if err != nil {
+			return Entry{}, fmt.Errorf("%s: no id", path)
+		}
+
+		e.ID = NoteID(id)
+	}
+
+	if e.Created.IsZero() {
+		info, err := os.Stat(path)
+		if err != nil {
+			return Entry{}, err
+		}
+
+		e.Created = info.ModTime()
+	}
+
+	return e, nil
+}
+
+// files/note.go
+
+// frontMatterDelimiter separates the front matter (the note attributes) from the text.
+const frontMatterDelimiter = "---"
+
+// formatNote renders the note as Markdown with the attributes in the front matter.
+func formatNote(e Entry) []byte {
+	var b strings.Builder
+
+	fmt.Fprintln(&b, frontMatterDelimiter)
+	fmt.Fprintf(&b, "id: %d\n", e.ID)
+	fmt.Fprintf(&b, "tags: [%s]\n", strings.Join(e.Tags, ", "))
+	fmt.Fprintf(&b, "created: %s\n", e.Created.Format(time.RFC3339))
+	if !e.Expires.IsZero() {
+		fmt.Fprintf(&b, "expires: %s\n", e.Expires.Format(time.RFC3339))
+	}
+	if e.SharedBy != "" {
+		fmt.Fprintf(&b, "shared_by: %s\n", e.SharedBy)
+	}
+	if e.Priority != PriorityNormal {
+		fmt.Fprintf(&b, "priority: %s\n", e.Priority)
+	}
+	if e.PagePath != "" {
+		fmt.Fprintf(&b, "page: %s\n", e.PagePath)
+	}
+	fmt.Fprintln(&b, frontMatterDelimiter)
+	fmt.Fprintln(&b, e.Text)
+
+	return []byte(b.String())
+}
+
+// parseNote reads the note rendered by formatNote.
+// A file without the front matter (e.g. written by hand) is read as the text of a note without attributes.
+func parseNote(s string) (Entry, error) {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	if !strings.HasPrefix(s, frontMatterDelimiter+"\n") {
+		return Entry{Text: strings.TrimSuffix(s, "\n")}, nil
+	}
+
+	head, text, ok := strings.Cut(strings.TrimPrefix(s, frontMatterDelimiter+"\n"), "\n"+frontMatterDelimiter+"\n")
+	if !ok {
+		return Entry{Text: strings.TrimSuffix(s, "\n")}, nil
+	}
+
+	var e Entry
+	for _, line := range strings.Split(head, "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+
+		value = strings.TrimSpace(value)
+
+		var err error
+		switch strings.TrimSpace(key) {
+		case "id":
+			var id int
+			id, err = strconv.Atoi(value)
+			e.ID = NoteID(id)
+		case "tags":
+			for _, t := range strings.Split(strings.Trim(value, "[]"), ",") {
+				if t = strings.TrimSpace(t); t != "" {
+					e.Tags = append(e.Tags, t)
+				}
+			}
+		case "created":
+			e.Created, err = time.Parse(time.RFC3339, value)
+		case "expires":
+			e.Expires, err = time.Parse(time.RFC3339, value)
+		case "shared_by":
+			e.SharedBy = value
+		case "page":
+			e.PagePath = value
+		case "priority":
+			var ok bool
+			if e.Priority, ok = ParsePriority(value); !ok {
+				err = errors.New("unknown priority")
+			}
+		}
+
+		if err != nil {
+			return Entry{}, fmt.Errorf("bad %s: %w", key, err)
+		}
+	}
+
+	e.Text = strings.TrimSuffix(text, "\n")
+
+	return e, nil
+}
+
+// files/db_provider.go
+
+// NewFilesDBProvider keeps the notes as Markdown files in the directory, one subdirectory per user.
+// The changes are reported to onChange (if set) once they are on disk.
+func NewFilesDBProvider(dir string, onChange func(uid UserID, msg string) error) DBProvider {
+	return &filesDBProvider{
+		dir:      dir,
+		onChange: onChange,
+		repo:     map[UserID]DB{},
+	}
+}
+
+type filesDBProvider struct {
+	sync.RWMutex
+	dir      string
+	onChange func(uid UserID, msg string) error
+	repo     map[UserID]DB
+}
+
+// filesDBProvider implements the DBProvider interface.
+var _ DBProvider = (*filesDBProvider)(nil)
+
+// ProvideDB returns a DB keeping the notes of the given user in their subdirectory.
+func (fdbp *filesDBProvider) ProvideDB(uid UserID) DB {
+	fdbp.RLock()
+	db := fdbp.repo[uid]
+	fdbp.RUnlock()
+
+	if db != nil {
+		return db
+	}
+
+	fdbp.Lock()
+	defer fdbp.Unlock()
+
+	if db := fdbp.repo[uid]; db != nil {
+		return db
+	}
+
+	var onChange func(string) error
+	if fdbp.onChange != nil {
+		onChange = func(msg string) error {
+			return fdbp.onChange(uid, msg)
+		}
+	}
+
+	db = NewFilesDB(filepath.Join(fdbp.dir, strconv.Itoa(int(uid))), onChange)
+
+	fdbp.repo[uid] = db
+
+	return db
+}
+
+// ListUsers returns the users having a subdirectory.
+func (fdbp *filesDBProvider) ListUsers() []UserID {
+	files, err := os.ReadDir(fdbp.dir)
+	if err != nil {
+		log.Printf("Failed to list the users in %s: %v", fdbp.dir, err)
+		return nil
+	}
+
+	result := []UserID{}
+	for _, f := range files {
+		if uid, err := strconv.Atoi(f.Name()); err == nil && f.IsDir() {
+			result = append(result, UserID(uid))
+		}
+	}
+
+	return result
+}
+
+// git/db_provider.go
+
+// NewGitDBProvider keeps the notes as Markdown files in a git repository in the directory
+// (one subdirectory per user) and commits every change, pushing it to the remote in the background if it's set.
+func NewGitDBProvider(dir, remote string) (DBProvider, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	r := &gitRepo{
+		dir:    dir,
+		remote: remote,
+		pushes: make(chan struct{}, 1),
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, ".git")); errors.Is(err, os.ErrNotExist) {
+		if _, err := r.git(context.Background(), "init", "-q"); err != nil {
+			return nil, err
+		}
+	}
+
+	if remote != "" {
+		go r.push()
+	}
+
+	return NewFilesDBProvider(dir, r.commit), nil
+}
+
+// gitPushTimeout bounds a single push, so that a stuck remote doesn't hold the later ones.
+const gitPushTimeout = time.Minute
+
+// gitRepo is a git repository shared by the users.
+type gitRepo struct {
+	// Mutex serializes the git commands changing the index.
+	sync.Mutex
+	dir    string
+	remote string
+	// pushes wake the pusher up, coalescing the commits made while it's busy.
+	pushes chan struct{}
+}
+
+// commit commits the changes in the subdirectory of the user and schedules a push.
+// A change leaving the files as they were is not committed.
+func (r *gitRepo) commit(uid UserID, msg string) error {
+	r.Lock()
+	defer r.Unlock()
+
+	ctx := context.Background()
+	sub := strconv.Itoa(int(uid))
+	if _, err := r.git(ctx, "add", "-A", "--", sub); err != nil {
+		return err
+	}
+
+	status, err := r.git(ctx, "status", "--porcelain", "--", sub)
+	if err != nil {
+		return err
+	}
+
+	if status == "" {
+		return nil
+	}
+
+	if _, err := r.git(ctx, "commit", "-q", "-m", fmt.Sprintf("%s of user %d", msg, uid), "--", sub); err != nil {
+		return err
+	}
+
+	if r.remote != "" {
+		select {
+		case r.pushes <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// push pushes the commits to the remote whenever there are new ones.
+// A failed push is only logged, for the changes are already saved and the next push carries them.
+func (r *gitRepo) push() {
+	for range r.pushes {
+		ctx, cancel := context.WithTimeout(context.Background(), gitPushTimeout)
+		if _, err := r.git(ctx, "push", "-q", r.remote, "HEAD"); err != nil {
+			log.Printf("Failed to push to %s: %v", r.remote, err)
+		}
+
+		cancel()
+	}
+}
+
+// git runs the git command in the repository and returns its trimmed output.
+func (r *gitRepo) git(ctx context.Context, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-C", r.dir, "-c", "user.name=NotesWithTagsTelegramBot", "-c", "user.email=bot@localhost"}, args...)...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %w: %s", args[0], err, bytes.TrimSpace(out))
+	}
+
+	return string(bytes.TrimSpace(out)), nil
+}
+
+// outbox/outbox.go
+
+// NewOutbox starts sending the queued messages (including the ones left in the journal) until the context is done.
+// A message that fails to be sent is retried with a growing delay unless it's undeliverable,
+// while the messages to the other chats keep going.
+func NewOutbox(ctx context.Context, journal OutboxJournal, send func(OutgoingMessage) error) (Outbox, error) {
+	pending, err := journal.LoadOutbox()
+	if err != nil {
+		return nil, err
+	}
+
+	o := &outbox{
+		journal: journal,
+		send:    send,
+		pending: pending,
+		wake:    make(chan struct{}, 1),
+	}
+
+	go o.run(ctx)
+
+	return o, nil
+}
+
+type outbox struct {
+	sync.Mutex
+	journal OutboxJournal
+	send    func(OutgoingMessage) error
+	pending []OutgoingMessage
+	wake    chan struct{}
+}
+
+// outbox implements the Outbox interface.
+var _ Outbox = (*outbox)(nil)
+
+// maxOutboxDelay limits the delay between the attempts to send a message.
+const maxOutboxDelay = time.Minute
+
+// maxOutboxAttempts is how many times a message is tried before it's dropped.
+const maxOutboxAttempts = 10
+
+// outboxInterval keeps the outbox under the limit of about thirty messages a second Telegram puts on a bot.
+const outboxInterval = time.Second / 25
+
+// maxMessageLength keeps the messages within the 4096 characters Telegram allows,
+// with a margin for the characters Telegram counts twice (e.g. emoji).
+const maxMessageLength = 4000
+
+// Enqueue journals the message, split into the parts Telegram accepts, and wakes the sender up.
+func (o *outbox) Enqueue(m OutgoingMessage) error {
+	parts := []OutgoingMessage{m}
+	if utf8.RuneCountInString(m.Text) > maxMessageLength {
+		parts = nil
+		for _, txt := range splitText(m.Text, maxMessageLength) {
+			parts = append(parts, OutgoingMessage{ChatID: m.ChatID, Text: txt})
+		}
+
+		// Changing the keyboard along with the last part.
+		parts[len(parts)-1].Keyboard = m.Keyboard
+	}
+
+	o.Lock()
+	defer o.Unlock()
+
+	pending := append(append([]OutgoingMessage{}, o.pending...), parts...)
+	if err := o.journal.SaveOutbox(pending); err != nil {
+		return err
+	}
+
+	o.pending = pending
+
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// next returns the index of the first message due to be sent, skipping the chats waiting for a retry
+// to keep the messages of every chat in order. If there is none, it tells how long to wait for a retry (0 if nothing is pending).
+func (o *outbox) next(now time.Time) (int, time.Duration) {
+	waiting := map[int64]bool{}
+	var wait time.Duration
+	for i, m := range o.pending {
+		if waiting[m.ChatID] {
+			continue
+		}
+
+		if !m.NextAttempt.After(now) {
+			return i, 0
+		}
+
+		waiting[m.ChatID] = true
+		if d := m.NextAttempt.Sub(now); wait == 0 || d < wait {
+			wait = d
+		}
+	}
+
+	return -1, wait
+}
+
+// run sends the messages one by one.
+func (o *outbox) run(ctx context.Context) {
+	for {
+		o.Lock()
+		i, wait := o.next(time.Now())
+		var m OutgoingMessage
+		if i != -1 {
+			m = o.pending[i]
+		}
+		o.Unlock()
+
+		if i == -1 {
+			var retry <-chan time.Time
+			if wait != 0 {
+				retry = time.After(wait)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-o.wake:
+			case <-retry:
+			}
+
+			continue
+		}
+
+		err := o.send(m)
+
+		// Only run removes the messages, so the index still points to the message.
+		o.Lock()
+		if err != nil && !errors.Is(err, ErrUndeliverable) && m.Attempts+1 < maxOutboxAttempts {
+			m.Attempts++
+			delay := time.Second << (m.Attempts - 1)
+			if delay > maxOutboxDelay {
+				delay = maxOutboxDelay
+			}
+
+			m.NextAttempt = time.Now().Add(delay)
+			o.pending[i] = m
+
+			log.Printf("Failed to send a message to chat %d, retrying in %v: %v", m.ChatID, delay, err)
+		} else {
+			if err != nil {
+				log.Printf("Dropped a message to chat %d: %v", m.ChatID, err)
+			}
+
+			o.pending = append(o.pending[:i:i], o.pending[i+1:]...)
+		}
+
+		if err := o.journal.SaveOutbox(o.pending); err != nil {
+			log.Printf("Failed to journal the outbox: %v", err)
+		}
+		o.Unlock()
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(outboxInterval):
+		}
+	}
+}
+
+// outbox/journal.go
+
+// NewFileOutboxJournal keeps the pending messages in the file as JSON.
+func NewFileOutboxJournal(path string) OutboxJournal {
+	return fileOutboxJournal{
+		path: path,
+	}
+}
+
+type fileOutboxJournal struct {
+	path string
+}
+
+// fileOutboxJournal implements the OutboxJournal interface.
+var _ OutboxJournal = fileOutboxJournal{}
+
+// LoadOutbox reads the pending messages from the file, none if there is no file.
+func (foj fileOutboxJournal) LoadOutbox() ([]OutgoingMessage, error) {
+	b, err := os.ReadFile(foj.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return []OutgoingMessage{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	result := []OutgoingMessage{}
+	if err := json.Unmarshal(b, &result); err != nil {
+		return nil, fmt.Errorf("%s: %w", foj.path, err)
+	}
+
+	return result, nil
+}
+
+// SaveOutbox replaces the file atomically, so that a crash never leaves it half-written.
+func (foj fileOutboxJournal) SaveOutbox(pending []OutgoingMessage) error {
+	b, err := json.Marshal(pending)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(foj.path), 0o755); err != nil {
+		return err
+	}
+
+	tmp := foj.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, foj.path)
+}
+
+// NewMemoryOutboxJournal keeps nothing for the storage backends that don't persist anything.
+func NewMemoryOutboxJournal() OutboxJournal {
+	return memoryOutboxJournal{}
+}
+
+type memoryOutboxJournal struct{}
+
+// memoryOutboxJournal implements the OutboxJournal interface.
+var _ OutboxJournal = memoryOutboxJournal{}
+
+// LoadOutbox returns no messages.
+func (memoryOutboxJournal) LoadOutbox() ([]OutgoingMessage, error) {
+	return []OutgoingMessage{}, nil
+}
+
+// SaveOutbox does nothing, for the outbox keeps the messages in memory anyway.
+func (memoryOutboxJournal) SaveOutbox([]OutgoingMessage) error {
+	return nil
+}
+
+// offset/offset.go
+
+// NewFileOffsetStore keeps the offset in the file.
+func NewFileOffsetStore(path string) OffsetStore {
+	return &fileOffsetStore{
+		path: path,
+	}
+}
+
+type fileOffsetStore struct {
+	// Mutex serializes the saves coming from the workers.
+	sync.Mutex
+	path  string
+	saved int
+}
+
+// fileOffsetStore implements the OffsetStore interface.
+var _ OffsetStore = (*fileOffsetStore)(nil)
+
+// LoadOffset reads the offset from the file, 0 if there is none.
+func (fos *fileOffsetStore) LoadOffset() (int, error) {
+	fos.Lock()
+	defer fos.Unlock()
+
+	b, err := os.ReadFile(fos.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	id, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, err
+	}
+
+	fos.saved = id
+
+	return id, nil
+}
+
+// SaveOffset replaces the file atomically, so that a crash never leaves it half-written.
+// The offset only grows, for the saves may come out of order.
+func (fos *fileOffsetStore) SaveOffset(id int) error {
+	fos.Lock()
+	defer fos.Unlock()
+
+	if id <= fos.saved {
+		return nil
+	}
+
+	dir := filepath.Dir(fos.path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, filepath.Base(fos.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(strconv.Itoa(id) + "\n"); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), fos.path); err != nil {
+		return err
+	}
+
+	fos.saved = id
+
+	return nil
+}
+
+// NewMemoryOffsetStore keeps the offset in memory for the storage backends that don't persist anything.
+func NewMemoryOffsetStore() OffsetStore {
+	return &memoryOffsetStore{}
+}
+
+type memoryOffsetStore struct {
+	sync.Mutex
+	id int
+}
+
+// memoryOffsetStore implements the OffsetStore interface.
+var _ OffsetStore = (*memoryOffsetStore)(nil)
+
+// LoadOffset returns the saved offset.
+func (mos *memoryOffsetStore) LoadOffset() (int, error) {
+	mos.Lock()
+	defer mos.Unlock()
+
+	return mos.id, nil
+}
+
+// SaveOffset remembers the offset unless a later one is remembered already.
+func (mos *memoryOffsetStore) SaveOffset(id int) error {
+	mos.Lock()
+	defer mos.Unlock()
+
+	if id > mos.id {
+		mos.id = id
+	}
+
+	return nil
+}
+
+// offset/tracker.go
+
+// offsetTracker tells the ID of the last update handled along with all the preceding ones,
+// for the updates are handled in parallel and may finish out of order.
+type offsetTracker struct {
+	sync.Mutex
+	inFlight map[int]bool
+	last     int
+}
+
+// newOffsetTracker creates a tracker of the updates following the given one.
+func newOffsetTracker(last int) *offsetTracker {
+	return &offsetTracker{
+		inFlight: map[int]bool{},
+		last:     last,
+	}
+}
+
+// start marks the update as being handled.
+func (ot *offsetTracker) start(id int) {
+	ot.Lock()
+	defer ot.Unlock()
+
+	ot.inFlight[id] = true
+}
+
+// done marks the update as handled and returns the ID of the last update safe to skip on restart.
+func (ot *offsetTracker) done(id int) int {
+	ot.Lock()
+	defer ot.Unlock()
+
+	delete(ot.inFlight, id)
+	if id > ot.last {
+		ot.last = id
+	}
+
+	result := ot.last
+	for inFlight := range ot.inFlight {
+		if inFlight <= result {
+			result = inFlight - 1
+		}
+	}
+
+	return result
+}
+
+// storage/storage.go
+
+// Storage is a kind of a storage backend.
+type Storage string
+
+const (
+	StorageMemory Storage = "memory"
+	StorageGit    Storage = "git"
+	StorageFiles  Storage = "fs"
+)
+
+// TODO: add the SQLite, Postgres, Redis and Bolt backends and serve them through NewCachedDBProvider
+// TODO: give the SQL backends a tuned connection pool, prepared statements for listing by tag and inserting, and batch inserts for /import
+// TODO: store the notes in MongoDB as documents with a tag array, indexed on the user and the tags
+
+// StorageOptions configure the persistent storage backends.
+type StorageOptions struct {
+	// DataDir is the directory the file-based backends keep the data in.
+	DataDir string
+	// GitRemote is the remote the git backend pushes to, empty to keep it local.
+	GitRemote string
+}
+
+// NewStorage builds the DB provider for the given storage backend.
+// Persistent backends keep the data of different namespaces (e.g. bots) apart.
+func NewStorage(s Storage, o StorageOptions, namespace string) (DBProvider, error) {
+	switch s {
+	case StorageMemory:
+		// Not cached, for it's in memory already.
+		return NewDBProvider(), nil
+	case StorageGit:
+		dbp, err := NewGitDBProvider(filepath.Join(o.DataDir, namespace), o.GitRemote)
+		if err != nil {
+			return nil, err
+		}
+
+		return NewCachedDBProvider(dbp), nil
+	case StorageFiles:
+		// Not cached, for the notes may be edited on disk directly.
+		return NewFilesDBProvider(filepath.Join(o.DataDir, namespace), nil), nil
+	}
+
+	return nil, fmt.Errorf("unknown storage %q", s)
+}
+
+// NewOffsetStore builds the store of the update offset of the bot for the given storage backend.
+// The file-based backends keep it next to the notes.
+func NewOffsetStore(s Storage, o StorageOptions, namespace string) OffsetStore {
+	if s == StorageGit || s == StorageFiles {
+		return NewFileOffsetStore(filepath.Join(o.DataDir, namespace+".offset"))
+	}
+
+	return NewMemoryOffsetStore()
+}
+
+// NewOutboxJournal builds the journal of the outbox of the bot for the given storage backend.
+// The file-based backends keep it next to the notes.
+func NewOutboxJournal(s Storage, o StorageOptions, namespace string) OutboxJournal {
+	if s == StorageGit || s == StorageFiles {
+		return NewFileOutboxJournal(filepath.Join(o.DataDir, namespace+".outbox"))
+	}
+
+	return NewMemoryOutboxJournal()
+}
+
+// config/config.go
+
+// Config holds the bot settings.
+type Config struct {
+	// Storage is the storage backend (memory|git|fs).
+	Storage string
+	// StorageOptions configure the persistent storage backends.
+	StorageOptions StorageOptions
+	// Tokens are the Telegram bot tokens, one per bot run in the process.
+	Tokens []string
+	// Workers is the number of workers handling the updates of all the bots.
+	Workers int
+	// UpdateTimeout limits the time of handling a single update.
+	UpdateTimeout time.Duration
+	// Local makes the bot talk over stdin and stdout instead of Telegram.
+	Local bool
+	// Limits restrict what users can store.
+	Limits Limits
+	// Admins are the users allowed to run the admin commands.
+	Admins []UserID
+	// NaturalLanguage makes the bot interpret free-form messages as commands.
+	NaturalLanguage bool
+	// HTTPAddr is the address of the HTTP server, empty if it's disabled.
+	HTTPAddr string
+	// PublicURL is the URL the HTTP server is reachable at from the outside.
+	PublicURL string
+	// SMTP configures emailing notes.
+	SMTP SMTPConfig
+	// Webhooks let the users configure URLs receiving the note events.
+	Webhooks bool
+	// MaintenanceMessage is what the users see during the maintenance by default.
+	MaintenanceMessage string
+	// UsageStats count the command usage (but nothing personal) for /admin stats.
+	UsageStats bool
+	// Pprof serves the profiling endpoints under /debug/pprof/ on PprofAddr.
+	Pprof bool
+	// PprofAddr is apart from HTTPAddr and private by default, for the endpoints expose the command line with the tokens.
+	PprofAddr string
+	// TelegraphToken is the access token of the Telegraph account to publish notes with, empty to disable publishing.
+	TelegraphToken string
+}
+
+// SMTPConfig configures the SMTP server to send emails through, disabled if Addr is empty.
+type SMTPConfig struct {
+	Addr     string
+	Username string
+	Password string
+	From     string
+}
+
+// defaultMaxNoteLength leaves room for the header of /shownote and the prefix of /sendnote
+// within the 4096 characters of a Telegram message.
+const defaultMaxNoteLength = 3500
+
+// ParseConfig reads the bot settings from the command line.
+func ParseConfig() Config {
+	var c Config
+	var tokens, longNotes, admins string
+	flag.StringVar(&c.Storage, "storage", string(StorageMemory), "storage backend: memory|git|fs")
+	flag.StringVar(&c.StorageOptions.DataDir, "data-dir", "data", "directory the file-based storage backends keep the data in")
+	flag.StringVar(&c.StorageOptions.GitRemote, "git-remote", "", "remote the git storage backend pushes every change to, empty to keep it local")
+	flag.StringVar(&tokens, "tokens", "TOKEN", "comma-separated Telegram bot tokens")
+	flag.IntVar(&c.Workers, "workers", 16, "number of workers handling the updates of all the bots")
+	flag.DurationVar(&c.UpdateTimeout, "update-timeout", 10*time.Second, "time limit for handling a single update")
+	flag.BoolVar(&c.Local, "local", false, "read commands from stdin and print replies to stdout instead of running the bots")
+	flag.IntVar(&c.Limits.MaxNoteLength, "max-note-length", defaultMaxNoteLength, "maximum number of characters in a note, 0 means no limit")
+	flag.StringVar(&longNotes, "long-notes", string(RejectLongNotes), "what to do with the notes over the length limit: reject|split")
+	flag.IntVar(&c.Limits.MaxNotes, "max-notes", 10000, "default maximum number of notes per user, 0 means no limit")
+	flag.StringVar(&admins, "admins", "", "comma-separated IDs of the users allowed to run the admin commands")
+	flag.BoolVar(&c.NaturalLanguage, "natural-language", false, "interpret free-form messages as commands after a confirmation")
+	flag.StringVar(&c.HTTPAddr, "http-addr", "", "address of the HTTP server, e.g. :8080, empty to disable it")
+	flag.StringVar(&c.PublicURL, "public-url", "http://localhost:8080", "URL the HTTP server is reachable at from the outside")
+	flag.StringVar(&c.SMTP.Addr, "smtp-addr", "", "address of the SMTP server to email notes through, e.g. smtp.example.com:587, empty to disable emailing")
+	flag.StringVar(&c.SMTP.Username, "smtp-username", "", "username for the SMTP server")
+	flag.StringVar(&c.SMTP.Password, "smtp-password", "", "password for the SMTP server")
+	flag.StringVar(&c.SMTP.From, "smtp-from", "", "sender address of the emails")
+	flag.BoolVar(&c.Webhooks, "webhooks", false, "let the users configure URLs receiving the note events")
+	flag.StringVar(&c.MaintenanceMessage, "maintenance-message", "The bot is under maintenance! It'll be back soon.", "what the users see during the maintenance by default")
+	flag.BoolVar(&c.UsageStats, "usage-stats", false, "count the command usage (but nothing personal) for /admin stats")
+	flag.BoolVar(&c.Pprof, "pprof", false, "serve the profiling endpoints under /debug/pprof/ on -pprof-addr")
+	flag.StringVar(&c.PprofAddr, "pprof-addr", "localhost:6060", "private address to serve the profiling endpoints on")
+	flag.StringVar(&c.TelegraphToken, "telegraph-token", "", "access token of the Telegraph account to publish notes with, empty to disable publishing")
+	flag.Parse()
+
+	c.Tokens = strings.Split(tokens, ",")
+	c.Limits.LongNotes = LongNotePolicy(longNotes)
+
+	for _, a := range strings.Split(admins, ",") {
+		if uid, err := strconv.Atoi(a); err == nil {
+			c.Admins = append(c.Admins, UserID(uid))
+		}
+	}
+
+	return c
+}
+
+// pool/pool.go
+
+// Pool runs jobs on a fixed number of workers.
+type Pool chan func()
+
+// NewPool starts the given number of workers.
+func NewPool(workers int) Pool {
+	p := make(Pool)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range p {
+				job()
+			}
+		}()
+	}
+
+	return p
+}
+
+// main.go
+
+func main() {
+	// Reading the config.
+	cfg := ParseConfig()
+
+	// Cancelling all the work on shutdown.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Serving the profiling endpoints privately.
+	if cfg.Pprof {
+		debug := http.NewServeMux()
+		debug.HandleFunc("/debug/pprof/", pprof.Index)
+		debug.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		debug.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		debug.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		debug.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+		go serveHTTP(ctx, cfg.PprofAddr, debug)
+	}
+
+	// Serving the HTTP endpoints of all the bots.
+	mux := http.NewServeMux()
+	if cfg.HTTPAddr != "" {
+		go serveHTTP(ctx, cfg.HTTPAddr, mux)
+	}
+
+	// Running locally without Telegram.
+	if cfg.Local {
+		replierProvider, s := prepareBot(ctx, cfg, "local", mux, NewLocalMessenger(os.Stdout), nil)
+		s.Users.SaveUser(localUserID, "local")
+
+		runLocal(ctx, replierProvider, s.DeadLetters, os.Stdin, os.Stdout, cfg.UpdateTimeout)
+
+		return
+	}
+
+	// Preparing the workers shared by all the bots.
+	pool := NewPool(cfg.Workers)
+
+	// Running the bots.
+	var wg sync.WaitGroup
+	for _, token := range cfg.Tokens {
+		// Creating a bot.
+		bot, err := tgbotapi.NewBotAPI(token)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		log.Printf("Authorized on account %s", bot.Self.UserName)
+
+		// Sending the messages of the bot reliably.
+		outbox, err := NewOutbox(ctx, NewOutboxJournal(Storage(cfg.Storage), cfg.StorageOptions, bot.Self.UserName), NewTelegramSender(bot))
+		if err != nil {
+			log.Panic(err)
+		}
+
+		// Preparing the db isolated per bot and the replier provider.
+		replierProvider, s := prepareBot(ctx, cfg, bot.Self.UserName, mux, NewTelegramMessenger(outbox), NewTelegramChannelAdmins(bot))
+		offsets := NewOffsetStore(Storage(cfg.Storage), cfg.StorageOptions, bot.Self.UserName)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			runBot(ctx, bot, replierProvider, s, outbox, offsets, pool, cfg.UpdateTimeout)
+		}()
+	}
+
+	wg.Wait()
+
+	// TODO: backup
+	// TODO: encrypt the backups with an operator-supplied passphrase (age) and ask for it on restore
+	// TODO: restore
+	// TODO: migrate a JSON export into a persistent backend (validating counts) once both exist
+}
+
+// prepareBot prepares the storage, the services and the HTTP endpoints of a single bot.
+// The admins of the channels are looked up with channelAdmins if it's set.
+func prepareBot(ctx context.Context, cfg Config, namespace string, mux *http.ServeMux, m Messenger, channelAdmins func(ctx context.Context, channel UserID) ([]UserID, error)) (ReplierRepository, Services) {
+	db, err := NewStorage(Storage(cfg.Storage), cfg.StorageOptions, namespace)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	var hooks Webhooks
+	if cfg.Webhooks {
+		hooks = NewWebhooks(ctx)
+		db = NewHookedDBProvider(db, hooks)
+	}
+
+	go Sweep(ctx, db, time.Minute)
+
+	s := Services{
+		Limits:      cfg.Limits,
+		Quotas:      NewQuotas(cfg.Limits.MaxNotes),
+		Admins:      cfg.Admins,
+		Shares:      NewShareRepository(),
+		Users:       NewUserDirectory(),
+		Messenger:   m,
+		Inbox:       NewInbox(),
+		Keyboards:   NewKeyboards(),
+		DeadLetters: NewDeadLetters(),
+		Maintenance: NewMaintenance(cfg.MaintenanceMessage),
+		Broadcaster: NewBroadcaster(ctx, m),
+		Webhooks:    hooks,
+	}
+
+	s.Channels = NewChannelArchiver(db, s.Limits, s.Quotas, channelAdmins)
+
+	if cfg.NaturalLanguage {
+		s.Intents = NewRuleIntentParser()
+	}
+
+	if cfg.SMTP.Addr != "" {
+		s.Mailer = NewSMTPMailer(ctx, cfg.SMTP, m)
+	}
+
+	if cfg.UsageStats {
+		s.Stats = NewUsageStats()
+	}
+
+	if cfg.TelegraphToken != "" {
+		s.Publisher = NewTelegraphPublisher(cfg.TelegraphToken)
+	}
+
+	if cfg.HTTPAddr != "" {
+		s.PublicURL = strings.TrimSuffix(cfg.PublicURL, "/") + "/" + namespace
+	}
+
+	prefix := "/" + namespace
+	mux.Handle(prefix+"/", http.StripPrefix(prefix, NewHTTPHandler(db, s.Shares)))
+
+	return NewReplierRepository(db, s), s
+}
+
+// serveHTTP serves the handler on the address until the context is done.
+func serveHTTP(ctx context.Context, addr string, h http.Handler) {
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: h,
+	}
+
+	go func() {
+		<-ctx.Done()
+		srv.Shutdown(context.Background())
+	}()
+
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Panic(err)
+	}
+}
+
+// runBot accepts the updates of the bot and handles them on the pool until the context is done.
+func runBot(ctx context.Context, bot *tgbotapi.BotAPI, replierProvider ReplierRepository, s Services, outbox Outbox, offsets OffsetStore, pool Pool, timeout time.Duration) {
+	// Resuming after the last handled update.
+	last, err := offsets.LoadOffset()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	tracker := newOffsetTracker(last)
+
+	// Configuring the bot.
+	u := tgbotapi.NewUpdate(last + 1)
+	u.Timeout = 60
 
 	// Getting the update channel.
 	updates, err := bot.GetUpdatesChan(u)
@@ -338,52 +5912,309 @@ func main() {
 		log.Panic(err)
 	}
 
-	// Preparing the db and the replier provider.
-	db := NewDBProvider()
-	replierProvider := NewReplierRepository(db)
+	// Stopping on shutdown.
+	go func() {
+		<-ctx.Done()
+		bot.StopReceivingUpdates()
+	}()
 
 	// Accepting updates.
-	for updateGlobal := range updates {
+	var wg sync.WaitGroup
+	for update := range updates {
+		// Capturing the update.
+		update := update
+		tracker.start(update.UpdateID)
+
 		// Enabling the parallel execution.
-		go func() {
-			// Capturing the update.
-			update := updateGlobal
-			
-			// Skipping irrelevant input.
-			if update.Message == nil {
-				return
-			}
+		wg.Add(1)
+		pool <- func() {
+			defer wg.Done()
 
-			// Loggging debug info.
-			log.Printf("[%s] %s", update.Message.From.UserName, update.Message.Text)
+			// Finishing the accepted update even on shutdown, for its offset is saved afterwards.
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), timeout)
+			defer cancel()
 
-			// Preparing the reply.
-			uid := UserID(update.Message.From.ID)
-			reply := replierProvider.ProvideReplier(uid)
-			msg := update.Message
-			u := Update{
-				IsCommand: msg.IsCommand(),
-				Cmd:       msg.Command(),
-				Args:      strings.Split(msg.CommandArguments(), " "),
-				Text:      msg.Text,
+			handleUpdate(ctx, bot, replierProvider, s, outbox, update)
+
+			// Remembering the progress.
+			if err := offsets.SaveOffset(tracker.done(update.UpdateID)); err != nil {
+				log.Printf("Failed to save the offset of %s: %v", bot.Self.UserName, err)
 			}
+		}
+	}
 
-			// Replying.
-			txt, next := reply.Reply(u)
-			if next == nil {
-				replierProvider.DeleteReplier(uid)
-			} else {
-				replierProvider.SaveReplier(uid, next)
+	// Letting the accepted updates finish on shutdown.
+	wg.Wait()
+}
+
+// handleUpdate replies to a single update.
+func handleUpdate(ctx context.Context, bot *tgbotapi.BotAPI, replierProvider ReplierRepository, s Services, outbox Outbox, update tgbotapi.Update) {
+	// TODO: handle message reactions (✅ done, 📌 pin, 🗑 trash) once the client library delivers them and todos, pins and trash exist
+
+	// Archiving the posts of the channels the bot is an admin of.
+	if post := update.ChannelPost; post != nil {
+		text := post.Text
+		if text == "" {
+			text = post.Caption
+		}
+
+		if err := s.Channels.ArchivePost(ctx, UserID(post.Chat.ID), post.Chat.UserName, text); err != nil {
+			log.Printf("Failed to archive a post of %s: %v", post.Chat.Title, err)
+		}
+
+		return
+	}
+
+	// Skipping irrelevant input.
+	if update.Message == nil {
+		return
+	}
+
+	// Loggging debug info.
+	log.Printf("[%s@%s] %s", update.Message.From.UserName, bot.Self.UserName, update.Message.Text)
+
+	// TODO: pick the initial reply language from msg.From.LanguageCode once replies are localized (i18n)
+
+	// Preparing the reply.
+	uid := UserID(update.Message.From.ID)
+	s.Users.SaveUser(uid, update.Message.From.UserName)
+	msg := update.Message
+	u := Update{
+		IsCommand: msg.IsCommand(),
+		Cmd:       msg.Command(),
+		Args:      strings.Fields(msg.CommandArguments()),
+		Text:      msg.Text,
+	}
+
+	// Downloading the files only when they are expected, for each takes up to 20 MB of memory.
+	_, expected := replierProvider.ProvideReplier(uid).(*documentExpector)
+	if msg.Document != nil && expected {
+		d, err := downloadDocument(ctx, bot, msg.Document)
+		if err != nil {
+			log.Printf("Failed to download %s from %s: %v", msg.Document.FileName, msg.From.UserName, err)
+		}
+
+		u.Document = d
+	}
+
+	// Replying.
+	var txt string
+	if msg.Document != nil && !expected {
+		txt = fmt.Sprintf("Please, run %s first and send the file then!", GetCmdUsage("import"))
+	} else {
+		var err error
+		txt, err = converse(ctx, replierProvider, s.DeadLetters, uid, u)
+		if err != nil {
+			log.Printf("Failed to reply to %s: %v", update.Message.From.UserName, err)
+			txt = errorReply
+		}
+	}
+
+	// Sending the reply.
+	r := OutgoingMessage{
+		ChatID: update.Message.Chat.ID,
+		Text:   txt,
+	}
+	if s.Keyboards.Keyboard(uid) {
+		r.Keyboard = KeyboardShown
+	} else if s.Keyboards.TakeKeyboardChange(uid) {
+		r.Keyboard = KeyboardHidden
+	}
+
+	if err := outbox.Enqueue(r); err != nil {
+		log.Printf("Failed to queue the reply to %s: %v", update.Message.From.UserName, err)
+	}
+}
+
+// maxDocumentSize is the size of the largest file the bot downloads (the limit of the Bot API).
+const maxDocumentSize = 20 << 20
+
+// downloadDocument fetches the file sent to the bot.
+func downloadDocument(ctx context.Context, bot *tgbotapi.BotAPI, d *tgbotapi.Document) (*Document, error) {
+	if d.FileSize > maxDocumentSize {
+		return nil, fmt.Errorf("%d bytes is over the limit", d.FileSize)
+	}
+
+	url, err := bot.GetFileDirectURL(d.FileID)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxDocumentSize))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Document{
+		Name: d.FileName,
+		Data: data,
+	}, nil
+}
+
+// errorReply is sent when the reply fails.
+const errorReply = "Something went wrong! Please, try again later."
+
+// replyAttempts is how many times a failing reply to a read-only command is tried before the update becomes a dead letter.
+// The other updates are tried once, for a failed write might have been partly done.
+const replyAttempts = 3
+
+// readOnlyCmds are the commands that don't change anything, so they are safe to retry.
+var readOnlyCmds = map[string]bool{
+	"listnotes":    true,
+	"find":         true,
+	"recent":       true,
+	"today":        true,
+	"onthisday":    true,
+	"shownote":     true,
+	"channelnotes": true,
+}
+
+// isReadOnly tells whether handling the update changes nothing.
+func isReadOnly(u Update) bool {
+	return u.IsCommand && readOnlyCmds[u.Cmd]
+}
+
+// replyRetryDelay grows with every attempt to reply.
+const replyRetryDelay = 200 * time.Millisecond
+
+// maxDeadLetterDocument is the size of the largest file kept with a dead letter.
+const maxDeadLetterDocument = 1 << 20
+
+// converse replies to the update of the user and remembers the conversation if it's pending.
+// The update is kept as a dead letter if the reply keeps failing.
+func converse(ctx context.Context, replierProvider ReplierRepository, deadLetters DeadLetters, uid UserID, u Update) (string, error) {
+	r := replierProvider.ProvideReplier(uid)
+	txt, next, err := r.Reply(ctx, u)
+	for attempt := 1; err != nil && attempt < replyAttempts && isReadOnly(u); attempt++ {
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Duration(attempt) * replyRetryDelay):
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+
+		txt, next, err = r.Reply(ctx, u)
+	}
+
+	if next == nil {
+		replierProvider.DeleteReplier(uid)
+	} else {
+		replierProvider.SaveReplier(uid, next)
+	}
+
+	if err != nil {
+		// Keeping the large files out of memory, the user is asked to send them again on replay.
+		if u.Document != nil && len(u.Document.Data) > maxDeadLetterDocument {
+			u.Document = nil
+		}
+
+		deadLetters.AddDeadLetter(DeadLetter{
+			UserID:  uid,
+			Update:  u,
+			Replier: r,
+			Err:     err.Error(),
+			Time:    time.Now(),
+		})
+	}
+
+	return txt, err
+}
+
+// local.go
+
+// localUserID is the user talking to the bot locally.
+const localUserID UserID = 0
+
+// runLocal replies to the messages read line by line from in until it's over or the context is done.
+func runLocal(ctx context.Context, replierProvider ReplierRepository, deadLetters DeadLetters, in io.Reader, out io.Writer, timeout time.Duration) {
+	scanner := bufio.NewScanner(in)
+	for ctx.Err() == nil && scanner.Scan() {
+		func() {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			txt, err := converse(ctx, replierProvider, deadLetters, localUserID, parseUpdate(scanner.Text()))
+			if err != nil {
+				log.Printf("Failed to reply: %v", err)
+				txt = errorReply
 			}
 
-			// Sending the reply.
-			r := tgbotapi.NewMessage(update.Message.Chat.ID, "")
-			r.Text = txt
-			bot.Send(r)
+			fmt.Fprintln(out, txt)
 		}()
 	}
+}
+
+// NewLocalMessenger creates a messenger printing the messages to out.
+func NewLocalMessenger(out io.Writer) Messenger {
+	return localMessenger{
+		out: out,
+	}
+}
 
-	// TODO: exit gracefully
-	// TODO: backup
-	// TODO: restore
+type localMessenger struct {
+	out io.Writer
+}
+
+// localMessenger implements the Messenger interface.
+var _ Messenger = localMessenger{}
+
+// SendMessage prints the message along with its recipient.
+func (lm localMessenger) SendMessage(ctx context.Context, uid UserID, txt string) error {
+	_, err := fmt.Fprintf(lm.out, "[to user %d] %s\n", uid, txt)
+
+	return err
+}
+
+// parseUpdate builds an update from the message text the way Telegram does.
+// A line like "< export.enex" sends the file instead.
+func parseUpdate(txt string) Update {
+	u := Update{
+		Text: txt,
+	}
+
+	if path, ok := strings.CutPrefix(txt, "<"); ok {
+		path = strings.TrimSpace(path)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Printf("Failed to read %s: %v", path, err)
+			return u
+		}
+
+		u.Text = ""
+		u.Document = &Document{
+			Name: filepath.Base(path),
+			Data: data,
+		}
+
+		return u
+	}
+
+	if !strings.HasPrefix(txt, "/") {
+		return u
+	}
+
+	fields := strings.Fields(txt)
+
+	u.IsCommand = true
+	u.Cmd = strings.SplitN(strings.TrimPrefix(fields[0], "/"), "@", 2)[0]
+	u.Args = fields[1:]
+
+	return u
 }
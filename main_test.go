@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// benchmarkNotes is the number of notes the benchmarks work with.
+const benchmarkNotes = 1000
+
+// benchmarkEntry makes the i-th note of the benchmarks.
+func benchmarkEntry(i int) Entry {
+	return Entry{
+		ID:      NoteID(i),
+		Text:    fmt.Sprintf("Note %d about the quarterly report and the meeting notes", i),
+		Tags:    []string{"work", fmt.Sprintf("project%d", i%10)},
+		Created: time.Now().Add(-time.Duration(i) * time.Hour),
+	}
+}
+
+// BenchmarkReply dispatches a listing command over a filled DB.
+func BenchmarkReply(b *testing.B) {
+	ctx := context.Background()
+	db := NewDBProvider().ProvideDB(localUserID)
+	for i := 0; i < benchmarkNotes; i++ {
+		if _, err := db.CreateNote(ctx, benchmarkEntry(i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	ce := NewCmdExecer(localUserID, db, Services{
+		Quotas:      NewQuotas(0),
+		Shares:      NewShareRepository(),
+		Users:       NewUserDirectory(),
+		Inbox:       NewInbox(),
+		Keyboards:   NewKeyboards(),
+		DeadLetters: NewDeadLetters(),
+		Maintenance: NewMaintenance(""),
+	})
+
+	u := Update{
+		IsCommand: true,
+		Cmd:       "listnotes",
+		Args:      []string{"--tag", "project3"},
+		Text:      "/listnotes --tag project3",
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := ce.Reply(ctx, u); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkFilterMatch matches the notes by tags and phrases.
+func BenchmarkFilterMatch(b *testing.B) {
+	entries := make([]Entry, benchmarkNotes)
+	for i := range entries {
+		entries[i] = benchmarkEntry(i)
+	}
+
+	f := Filter{
+		Tags:         []string{"work"},
+		ExcludedTags: []string{"project1"},
+		Phrases:      []string{"meeting notes"},
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, e := range entries {
+			f.Match(e)
+		}
+	}
+}
+
+// BenchmarkParseQuery parses a search query of every kind of term.
+func BenchmarkParseQuery(b *testing.B) {
+	q := `tag:work -tag:personal "meeting notes" before:2024-01-01 after:2023-01-01 priority:high`
+
+	for i := 0; i < b.N; i++ {
+		if _, err := ParseQuery(q); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// TestFilesDBHandWrittenNotes reads the notes written on disk without the front matter
+// and keeps working around the broken ones.
+func TestFilesDBHandWrittenNotes(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	db := NewFilesDB(dir, nil)
+	if _, err := db.CreateNote(ctx, Entry{Text: "Written by the bot", Tags: []string{"work"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "7.md"), []byte("Written by hand\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "8.md"), []byte("---\ncreated: yesterday\n---\nBroken\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := db.ListNotes(ctx, Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 2 || entries[1].ID != 7 || entries[1].Text != "Written by hand" || len(entries[1].Tags) != 0 {
+		t.Fatalf("got %+v, want the note of the bot and note #7 written by hand", entries)
+	}
+
+	// Restarting, as the files are usually edited while the bot is down.
+	e, err := NewFilesDB(dir, nil).CreateNote(ctx, Entry{Text: "After the hand-written ones"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e.ID != 9 {
+		t.Fatalf("got note #%d, want #9 after the hand-written #7 and #8", e.ID)
+	}
+}
+
+// TestSplitText splits on whitespace without leaving empty parts.
+func TestSplitText(t *testing.T) {
+	got := splitText("  abcde fghij", 5)
+	if len(got) != 2 || got[0] != "abcde" || got[1] != "fghij" {
+		t.Fatalf("got %q, want [abcde fghij]", got)
+	}
+}
+
+// TestOutbox splits the long messages and keeps sending to the other chats while one is failing.
+func TestOutbox(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	sent := []OutgoingMessage{}
+	o, err := NewOutbox(ctx, NewMemoryOutboxJournal(), func(m OutgoingMessage) error {
+		if m.ChatID == 1 {
+			return errors.New("flaky")
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		sent = append(sent, m)
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range []OutgoingMessage{
+		{ChatID: 1, Text: "stuck"},
+		{ChatID: 2, Text: strings.Repeat("word ", 1000), Keyboard: KeyboardShown},
+	} {
+		if err := o.Enqueue(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	time.Sleep(500 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(sent) != 2 || sent[0].Keyboard != KeyboardUnchanged || sent[1].Keyboard != KeyboardShown {
+		t.Fatalf("got %d messages to chat 2, want 2 parts with the keyboard on the last one", len(sent))
+	}
+
+	for _, m := range sent {
+		if n := len([]rune(m.Text)); n > maxMessageLength {
+			t.Fatalf("got a part of %d characters, want at most %d", n, maxMessageLength)
+		}
+	}
+}
+
+// TestCachedDBEvicts keeps the number of the cached results within the limit.
+func TestCachedDBEvicts(t *testing.T) {
+	ctx := context.Background()
+	c := NewCachedDB(NewDBProvider().ProvideDB(localUserID)).(*cachedDB)
+	for i := 0; i < 2*maxCachedResults; i++ {
+		if _, err := c.ListNotes(ctx, Filter{Phrases: []string{fmt.Sprint(i)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := c.results.Len(); n != maxCachedResults || len(c.index) != maxCachedResults {
+		t.Fatalf("got %d cached results, want %d", n, maxCachedResults)
+	}
+}